@@ -12,18 +12,27 @@ import (
 func main() {
 	inputFile := flag.String("i", "", "input file")
 	outputFile := flag.String("o", "", "output file")
+	presetFile := flag.String("p", "", "preset dictionary file, made by train")
 	flag.Parse()
 
 	if *inputFile == "" || *outputFile == "" {
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
+	var preset []byte
+	if *presetFile != "" {
+		var err error
+		preset, err = ioutil.ReadFile(*presetFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	fileIn, err := os.Open(*inputFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 	var blastReader io.ReadCloser
-	blastReader, err = blast.NewReader(fileIn)
+	blastReader, err = blast.NewReaderDict(fileIn, preset)
 	if err != nil {
 		log.Fatal(err)
 	}
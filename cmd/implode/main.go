@@ -12,28 +12,46 @@ import (
 func main() {
 	inputFile := flag.String("i", "", "input file")
 	outputFile := flag.String("o", "", "output file")
+	mode := flag.String("m", "binary", "compression mode: binary, ascii or auto")
+	dict := flag.String("d", "1024", "dictionary size: 1024, 2048, 4096 or auto")
+	presetFile := flag.String("p", "", "preset dictionary file, made by train")
 	flag.Parse()
 
 	if *inputFile == "" || *outputFile == "" {
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
+	implodeType, ok := map[string]uint{"binary": blast.Binary, "ascii": blast.ASCII, "auto": blast.ModeAuto}[*mode]
+	if !ok {
+		log.Fatalf("invalid compression mode %q", *mode)
+	}
+	dictSize, ok := map[string]uint{"1024": blast.DictionarySize1024, "2048": blast.DictionarySize2048, "4096": blast.DictionarySize4096, "auto": blast.DictionarySizeAuto}[*dict]
+	if !ok {
+		log.Fatalf("invalid dictionary size %q", *dict)
+	}
+	var preset []byte
+	if *presetFile != "" {
+		var err error
+		preset, err = ioutil.ReadFile(*presetFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	fileIn, err := os.Open(*inputFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 	var b bytes.Buffer
-	w := blast.NewWriter(&b, blast.Binary, blast.DictionarySize1024)
-	decoded, err := ioutil.ReadAll(fileIn)
+	w := blast.NewWriterDict(&b, implodeType, dictSize, preset)
+	_, err = w.ReadFrom(fileIn)
 	if err != nil {
 		log.Fatal(err)
 	}
 	fileIn.Close()
-	_, err = w.Write(decoded)
+	err = w.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
-	w.Close()
 	err = ioutil.WriteFile(*outputFile, b.Bytes(), 0777)
 	if err != nil {
 		log.Fatal(err)
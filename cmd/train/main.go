@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/JoshVarga/blast"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// compressed returns the total size of the samples compressed one by
+// one, with the preset dictionary dict if it is not nil.
+func compressed(samples [][]byte, dict []byte) int {
+	total := 0
+	for _, sample := range samples {
+		var b bytes.Buffer
+		w := blast.NewWriterDict(&b, blast.ModeAuto, blast.DictionarySizeAuto, dict)
+		_, err := w.Write(sample)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		total += b.Len()
+	}
+	return total
+}
+
+func main() {
+	outputFile := flag.String("o", "", "output dictionary file")
+	size := flag.Uint("s", blast.DictionarySize4096, "dictionary size: 1024, 2048 or 4096")
+	holdout := flag.Int("holdout", 10, "keep every n-th sample out of training to measure the gain, 0 for none")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -o dict [flags] sample...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *outputFile == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if *size != blast.DictionarySize1024 && *size != blast.DictionarySize2048 && *size != blast.DictionarySize4096 {
+		log.Fatalf("invalid dictionary size %d", *size)
+	}
+	var training, heldOut [][]byte
+	for i, name := range flag.Args() {
+		sample, err := ioutil.ReadFile(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *holdout > 0 && i%*holdout == *holdout-1 {
+			heldOut = append(heldOut, sample)
+		} else {
+			training = append(training, sample)
+		}
+	}
+	dict := blast.TrainDictionary(training, blast.DictionarySize(*size))
+	err := ioutil.WriteFile(*outputFile, dict, 0666)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("dictionary: %d bytes from %d samples\n", len(dict), len(training))
+
+	if len(heldOut) == 0 {
+		return
+	}
+	raw := 0
+	for _, sample := range heldOut {
+		raw += len(sample)
+	}
+	without, with := compressed(heldOut, nil), compressed(heldOut, dict)
+	fmt.Printf("held out: %d samples, %d bytes\n", len(heldOut), raw)
+	fmt.Printf("without dictionary: %d bytes, ratio %.2f\n", without, float64(raw)/float64(without))
+	fmt.Printf("with dictionary: %d bytes, ratio %.2f (%.1f%% smaller)\n", with, float64(raw)/float64(with), 100*(1-float64(with)/float64(without)))
+}
@@ -0,0 +1,51 @@
+package blast_test
+
+import (
+	"bytes"
+	"hash"
+	"hash/crc32"
+	"testing"
+
+	"github.com/JoshVarga/blast"
+)
+
+func TestCrc32(t *testing.T) {
+	data := []byte("123456789")
+	if crc := blast.Crc32(data, 0xFFFFFFFF); crc != ^uint32(0xCBF43926) {
+		t.Errorf("found=%#x : expected=%#x", crc, ^uint32(0xCBF43926))
+	}
+	if crc := blast.Crc32(data[4:], blast.Crc32(data[:4], 0)); crc != blast.Crc32(data, 0) {
+		t.Errorf("found=%#x in two parts : expected=%#x", crc, blast.Crc32(data, 0))
+	}
+
+	text := benchmarkText(10000)
+	for _, test := range []struct {
+		name     string
+		h        hash.Hash32
+		expected uint32
+	}{
+		{"NewCrc32", blast.NewCrc32(), crc32.ChecksumIEEE(text)},
+		{"NewCrc32Raw", blast.NewCrc32Raw(0xFFFFFFFF), blast.Crc32(text, 0xFFFFFFFF)},
+		{"NewCrc32Raw", blast.NewCrc32Raw(0x12345678), blast.Crc32(text, 0x12345678)},
+	} {
+		h := test.h
+		for i := 0; i < 2; i++ {
+			// Written in parts of decreasing size
+			for p := text; len(p) > 0; p = p[len(p)-len(p)/2:] {
+				_, _ = h.Write(p[:len(p)-len(p)/2])
+			}
+			if h.Sum32() != test.expected {
+				t.Errorf("%v: found=%#x : expected=%#x", test.name, h.Sum32(), test.expected)
+			}
+			s := test.expected
+			if sum := h.Sum([]byte("prefix")); !bytes.Equal(sum, []byte{'p', 'r', 'e', 'f', 'i', 'x', byte(s >> 24), byte(s >> 16), byte(s >> 8), byte(s)}) {
+				t.Errorf("%v: found=%x from Sum", test.name, sum)
+			}
+			// Reset starts over with the same data
+			h.Reset()
+		}
+		if h.Size() != 4 || h.BlockSize() != 1 {
+			t.Errorf("%v: found=%v, %v : expected=4, 1", test.name, h.Size(), h.BlockSize())
+		}
+	}
+}
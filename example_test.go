@@ -41,3 +41,13 @@ func ExampleNewReader() {
 	if err != nil {
 	}
 }
+
+func ExampleReadHeader() {
+	buff := []byte{0, 4, 130, 36, 37, 143, 128, 127}
+	header, err := blast.ReadHeader(bytes.NewReader(buff))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(header.Mode, header.DictionarySize)
+	// Output: binary 1024
+}
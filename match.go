@@ -0,0 +1,355 @@
+package blast
+
+import (
+	"encoding/binary"
+	mathbits "math/bits"
+)
+
+// A matchFinder searches the work buffer for earlier repetitions of the
+// bytes to compress. The positions before the one searched are added to
+// it as the search moves forward through the buffer.
+type matchFinder interface {
+	// Starts a new stream, whose first byte is at workBuff[offset].
+	reset(offset uint)
+	// Moves the work buffer down by n bytes.
+	shift(n uint)
+	// Returns the length and the distance of the longest repetition of
+	// the bytes at buffer[offset], of at most maxLength bytes and at most
+	// maxDistance bytes back, or zero. Of repetitions of the same length,
+	// the closest one is found. A repetition of 2 bytes is at most 0x100
+	// bytes back.
+	find(buffer []uint8, offset, maxLength, maxDistance uint) (length, distance uint)
+	// Visits the repetitions of the bytes at buffer[offset] from the
+	// closest one back. For each repetition longer than the ones before
+	// it, visit is called with the range of lengths it adds and its
+	// distance. The closest repetition of 2 bytes is visited first, even
+	// if it is more than 0x100 bytes back.
+	walk(buffer []uint8, offset, maxLength, maxDistance uint, visit func(from, to, distance uint))
+}
+
+// Hash chains for the match search. Positions are absolute, counted from
+// the start of the first stream compressed, so that they stay valid when
+// the work buffer is moved down by a block. A chain links the positions
+// with the same hash, most recent first. Repetitions of 3 bytes or more
+// are searched in the chains of 3-byte hashes, and repetitions of 2 bytes
+// in the chains of the byte pairs, which are only followed 0x100 bytes
+// back.
+const (
+	chainHashBits = 14
+	chainHashSize = 1 << chainHashBits
+	chainSize     = 1 << 14 // more than the dictionary, a block and the data loaded past it
+	chainMask     = chainSize - 1
+)
+
+type hashChain struct {
+	head     [chainHashSize]uint32 // Most recent position of each 3-byte hash
+	prev     [chainSize]uint32     // Previous position with the same 3-byte hash
+	pairHead [chainHashSize]uint32 // Most recent position of each byte pair hash
+	pairPrev [chainSize]uint32     // Previous position with the same byte pair hash
+	base     uint32                // Absolute position of workBuff[0]
+	start    uint32                // Absolute position of the start of the stream
+	next     uint32                // Absolute position of the next position to insert
+	probes   int                   // Maximum number of chain positions to compare
+	nice     uint                  // Stop searching at a repetition of this length
+}
+
+// A compression level, see the level constants.
+type levelConfig struct {
+	probes int  // Maximum number of chain positions to compare
+	nice   uint // Stop searching at a repetition of this length
+	lazy   bool // Look for a longer repetition at the next position
+}
+
+var levels = [BestCompression + 1]levelConfig{
+	1: {4, 16, false},
+	2: {8, 32, false},
+	3: {16, 64, false},
+	4: {16, 32, true},
+	5: {32, 64, true},
+	6: {64, 128, true},
+	7: {128, 256, true},
+	8: {512, maxRepLength, true},
+	9: {4096, maxRepLength, true},
+}
+
+// The search of DefaultCompression and MaxCompression, which compares
+// every position of the dictionary
+var exhaustive = levelConfig{chainSize, maxRepLength, false}
+
+func newHashChain(cfg levelConfig) *hashChain {
+	return &hashChain{probes: cfg.probes, nice: cfg.nice}
+}
+
+// The positions of the previous stream are skipped, so that they are too
+// far back to be found by a search.
+func (c *hashChain) reset(offset uint) {
+	c.rebase()
+	c.base += c.next - c.base + chainSize
+	c.start = c.base + uint32(offset)
+	c.next = c.start
+}
+
+func (c *hashChain) shift(n uint) {
+	c.base += uint32(n)
+	c.rebase()
+}
+
+// Moves the positions down once they are large enough to wrap around,
+// so that positions left in the chains by earlier streams never look
+// recent, and the output doesn't depend on what was compressed before.
+// The positions before workBuff[0] can't be searched, and become 0,
+// which is always too far back.
+func (c *hashChain) rebase() {
+	if c.next < 1<<31 {
+		return
+	}
+	// A multiple of chainSize, which keeps the index of each position
+	delta := (c.base - chainSize) &^ chainMask
+	move := func(pos uint32) uint32 {
+		if pos < c.base {
+			return 0
+		}
+		return pos - delta
+	}
+	for i := range c.head {
+		c.head[i] = move(c.head[i])
+		c.pairHead[i] = move(c.pairHead[i])
+	}
+	for i := range c.prev {
+		c.prev[i] = move(c.prev[i])
+		c.pairPrev[i] = move(c.pairPrev[i])
+	}
+	c.start = move(c.start)
+	c.base -= delta
+	c.next -= delta
+}
+
+func pairHash(buffer []uint8, offset uint) uint32 {
+	return (uint32(buffer[offset])<<6 ^ uint32(buffer[offset+1])) & (chainHashSize - 1)
+}
+
+func tripleHash(buffer []uint8, offset uint) uint32 {
+	v := uint32(buffer[offset]) | uint32(buffer[offset+1])<<8 | uint32(buffer[offset+2])<<16
+	return v * 0x9E3779B1 >> (32 - chainHashBits)
+}
+
+// Inserts the positions before workBuff[offset] into the chains.
+func (c *hashChain) insert(buffer []uint8, offset uint) {
+	for end := c.base + uint32(offset); c.next < end; c.next++ {
+		o := uint(c.next - c.base)
+		hash := tripleHash(buffer, o)
+		c.prev[c.next&chainMask] = c.head[hash]
+		c.head[hash] = c.next
+		hash = pairHash(buffer, o)
+		c.pairPrev[c.next&chainMask] = c.pairHead[hash]
+		c.pairHead[hash] = c.next
+	}
+}
+
+// Returns the most recent position of a chain before pos, skipping the
+// positions inserted past pos by an earlier search.
+func (c *hashChain) first(head uint32, prev *[chainSize]uint32, pos uint32) uint32 {
+	for int32(pos-head) <= 0 && int32(c.next-head) > 0 {
+		head = prev[head&chainMask]
+	}
+	return head
+}
+
+// Returns the distance of the closest repetition of the byte pair at
+// buffer[offset], at most maxDistance bytes back, or zero.
+func (c *hashChain) findPair(buffer []uint8, offset, maxDistance uint) uint {
+	pos := c.base + uint32(offset)
+	cand := c.first(c.pairHead[pairHash(buffer, offset)], &c.pairPrev, pos)
+	for probes := c.probes; probes > 0; probes-- {
+		dist := uint(pos - cand)
+		if dist == 0 || dist > maxDistance {
+			break
+		}
+		if buffer[offset-dist] == buffer[offset] && buffer[offset-dist+1] == buffer[offset+1] {
+			return dist
+		}
+		next := c.pairPrev[cand&chainMask]
+		if uint(pos-next) <= dist {
+			break
+		}
+		cand = next
+	}
+	return 0
+}
+
+// Searches the chains of 3-byte hashes from the closest position back,
+// and calls visit for each repetition longer than the ones before it.
+// Stops when visit returns false.
+func (c *hashChain) search(buffer []uint8, offset, maxLength, maxDistance uint, visit func(length, distance uint) bool) {
+	pos := c.base + uint32(offset)
+	length := uint(2)
+	cand := c.first(c.head[tripleHash(buffer, offset)], &c.prev, pos)
+	for probes := c.probes; probes > 0; probes-- {
+		dist := uint(pos - cand)
+		if dist == 0 || dist > maxDistance {
+			break
+		}
+		prev := offset - dist
+		// Only a repetition that is longer than the one found so far matters
+		if buffer[prev+length] == buffer[offset+length] {
+			if n := matchLength(buffer, prev, offset, maxLength); n > length {
+				length = n
+				if !visit(n, dist) || n == maxLength {
+					break
+				}
+			}
+		}
+		// The chain must lead further back, or it has been overwritten
+		next := c.prev[cand&chainMask]
+		if uint(pos-next) <= dist {
+			break
+		}
+		cand = next
+	}
+}
+
+// Limits the search to the start of the stream, and inserts the
+// positions up to offset.
+func (c *hashChain) prepare(buffer []uint8, offset, maxDistance uint) uint {
+	c.insert(buffer, offset)
+	if limit := uint(c.base + uint32(offset) - c.start); limit < maxDistance {
+		maxDistance = limit
+	}
+	return maxDistance
+}
+
+func (c *hashChain) find(buffer []uint8, offset, maxLength, maxDistance uint) (length, distance uint) {
+	if maxLength < 2 {
+		return 0, 0
+	}
+	maxDistance = c.prepare(buffer, offset, maxDistance)
+	if maxLength > 2 {
+		c.search(buffer, offset, maxLength, maxDistance, func(n, dist uint) bool {
+			length, distance = n, dist
+			return n < c.nice
+		})
+	}
+	if length == 0 {
+		if maxDistance > 0x100 {
+			maxDistance = 0x100
+		}
+		if distance = c.findPair(buffer, offset, maxDistance); distance != 0 {
+			length = 2
+		}
+	}
+	return length, distance
+}
+
+func (c *hashChain) walk(buffer []uint8, offset, maxLength, maxDistance uint, visit func(from, to, distance uint)) {
+	if maxLength < 2 {
+		return
+	}
+	maxDistance = c.prepare(buffer, offset, maxDistance)
+	if dist := c.findPair(buffer, offset, maxDistance); dist != 0 {
+		visit(2, 2, dist)
+	}
+	if maxLength > 2 {
+		from := uint(3)
+		c.search(buffer, offset, maxLength, maxDistance, func(n, dist uint) bool {
+			visit(from, n, dist)
+			from = n + 1
+			return true
+		})
+	}
+}
+
+// Returns the number of equal bytes at buffer[prev:] and buffer[offset:],
+// up to maxLength.
+func matchLength(buffer []uint8, prev, offset, maxLength uint) uint {
+	n := uint(0)
+	for ; n+8 <= maxLength; n += 8 {
+		diff := binary.LittleEndian.Uint64(buffer[prev+n:]) ^ binary.LittleEndian.Uint64(buffer[offset+n:])
+		if diff != 0 {
+			return n + uint(mathbits.TrailingZeros64(diff)>>3)
+		}
+	}
+	for ; n < maxLength && buffer[prev+n] == buffer[offset+n]; n++ {
+	}
+	return n
+}
+
+// Returns the number of bits taken by a repetition of repLength bytes,
+// distance bytes back.
+func repetitionBits(pWork *tCmpStruct, repLength, distance uint) uint {
+	distance--
+	if repLength == 2 {
+		return uint(pWork.nChBits[repLength+0xFE]) + uint(pWork.distBits[distance>>2]) + 2
+	}
+	return uint(pWork.nChBits[repLength+0xFE]) + uint(pWork.distBits[distance>>pWork.dsizeBits]) + pWork.dsizeBits
+}
+
+// Returns the number of bits taken by the n bytes at workBuff[offset]
+// stored as literals.
+func literalBits(pWork *tCmpStruct, offset, n uint) uint {
+	total := uint(0)
+	for _, ch := range pWork.workBuff[offset : offset+n] {
+		total += uint(pWork.nChBits[ch])
+	}
+	return total
+}
+
+// Compresses the bytes from workBuff[workBuffOffset] up to inputDataEndIndex
+// using the search of the compression level, and returns the offset at which
+// compression stopped. Repetitions can extend up to dataEndIndex, the end of
+// the loaded data.
+func compressChains(pWork *tCmpStruct, workBuffOffset, inputDataEndIndex, dataEndIndex uint) (uint, error) {
+	f := pWork.finder
+	lazy := levels[pWork.level].lazy
+	nice := levels[pWork.level].nice
+	buffer := pWork.workBuff
+	maxDistance := pWork.dsizeBytes - 1
+
+	// find the longest repetition at offset, if it takes less bits than literals
+	find := func(offset uint) (uint, uint) {
+		maxLength := dataEndIndex - offset
+		if maxLength > maxRepLength {
+			maxLength = maxRepLength
+		}
+		repLength, distance := f.find(buffer, offset, maxLength, maxDistance)
+		if repLength != 0 && repLength < 8 && repetitionBits(pWork, repLength, distance) >= literalBits(pWork, offset, repLength) {
+			return 0, 0
+		}
+		return repLength, distance
+	}
+
+	var repLength, distance uint
+	if workBuffOffset < inputDataEndIndex {
+		repLength, distance = find(workBuffOffset)
+	}
+	for workBuffOffset < inputDataEndIndex {
+		if repLength != 0 && lazy && repLength < nice && workBuffOffset+1 < inputDataEndIndex {
+			// If there is a longer repetition one byte later,
+			// store this byte as a literal and try again from there
+			nextLength, nextDistance := find(workBuffOffset + 1)
+			if nextLength > repLength {
+				if err := outputLiteral(pWork, buffer[workBuffOffset]); err != nil {
+					return 0, err
+				}
+				workBuffOffset++
+				repLength, distance = nextLength, nextDistance
+				continue
+			}
+		}
+		if repLength != 0 {
+			pWork.distance = distance - 1
+			if err := outputRepetition(pWork, repLength); err != nil {
+				return 0, err
+			}
+			workBuffOffset += repLength
+		} else {
+			if err := outputLiteral(pWork, buffer[workBuffOffset]); err != nil {
+				return 0, err
+			}
+			workBuffOffset++
+		}
+		if workBuffOffset < inputDataEndIndex {
+			repLength, distance = find(workBuffOffset)
+		}
+	}
+	return workBuffOffset, nil
+}
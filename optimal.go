@@ -0,0 +1,106 @@
+package blast
+
+// Optimal parsing for MaxCompression. The number of bits each literal and
+// repetition takes is fixed by the compression type and dictionary size,
+// so the sequence of literals and repetitions that takes the fewest bits
+// can be found as the shortest path through the block, where each byte
+// position is a node and each literal or repetition starting there is an
+// edge. The bits taken by a distance never decrease as the distance grows,
+// so for each repetition length only the closest repetition matters.
+// The path is found up to the end of the loaded data, past the end of
+// the block, so that the steps that cross into the next block are chosen
+// knowing what follows. A repetition of optimalNice bytes or more is taken
+// as it is, without looking for a better path through the bytes it covers.
+
+const (
+	parseSize     = 0x1000 + 0x204 + 1 // A block, and the data loaded past its end
+	optimalNice   = 0x100
+	unreachedCost = ^uint32(0)
+)
+
+type optimalParse struct {
+	cost     [parseSize]uint32 // Fewest bits taken by the bytes up to each position
+	length   [parseSize]uint16 // Length of the step ending at each position, 1 for a literal
+	distance [parseSize]uint16 // Distance of the repetition ending at each position
+	steps    [parseSize]uint16 // Positions of the chosen steps, in reverse
+}
+
+// Compresses the bytes from workBuff[workBuffOffset] up to inputDataEndIndex
+// with the literals and repetitions that take the fewest bits, and returns
+// the offset at which compression stopped. Repetitions can extend up to
+// dataEndIndex, the end of the loaded data.
+func compressOptimal(pWork *tCmpStruct, workBuffOffset, inputDataEndIndex, dataEndIndex uint) (uint, error) {
+	if workBuffOffset >= inputDataEndIndex {
+		return workBuffOffset, nil
+	}
+	f := pWork.finder
+	p := pWork.parse
+	buffer := pWork.workBuff
+	maxDistance := pWork.dsizeBytes - 1
+	blockLength := inputDataEndIndex - workBuffOffset
+	last := dataEndIndex - workBuffOffset
+	for i := uint(1); i <= last; i++ {
+		p.cost[i] = unreachedCost
+	}
+	p.cost[0] = 0
+
+	for i := uint(0); i < last; {
+		offset := workBuffOffset + i
+		cost := p.cost[i]
+		if next := cost + uint32(pWork.nChBits[buffer[offset]]); next < p.cost[i+1] {
+			p.cost[i+1], p.length[i+1] = next, 1
+		}
+		maxLength := last - i
+		if maxLength > maxRepLength {
+			maxLength = maxRepLength
+		}
+		longest := uint(0)
+		f.walk(buffer, offset, maxLength, maxDistance, func(from, to, distance uint) {
+			if from == 2 {
+				if distance <= 0x100 {
+					if next := cost + uint32(repetitionBits(pWork, 2, distance)); next < p.cost[i+2] {
+						p.cost[i+2], p.length[i+2], p.distance[i+2] = next, 2, uint16(distance)
+					}
+				}
+				from = 3
+			}
+			// The bits of the distance are the same for all lengths above 2
+			distanceBits := cost + uint32(pWork.distBits[(distance-1)>>pWork.dsizeBits]) + uint32(pWork.dsizeBits)
+			for n := from; n <= to; n++ {
+				if next := distanceBits + uint32(pWork.nChBits[n+0xFE]); next < p.cost[i+n] {
+					p.cost[i+n], p.length[i+n], p.distance[i+n] = next, uint16(n), uint16(distance)
+				}
+			}
+			longest = to
+		})
+		if longest >= optimalNice {
+			i += longest
+		} else {
+			i++
+		}
+	}
+
+	// Output the steps of the path that start in the block
+	count := 0
+	for i := last; i > 0; i -= uint(p.length[i]) {
+		p.steps[count] = uint16(i)
+		count++
+	}
+	end := uint(0)
+	for count > 0 && end < blockLength {
+		count--
+		i := uint(p.steps[count])
+		if n := uint(p.length[i]); n == 1 {
+			if err := outputLiteral(pWork, buffer[workBuffOffset+end]); err != nil {
+				return 0, err
+			}
+		} else {
+			pWork.distance = uint(p.distance[i]) - 1
+			if err := outputRepetition(pWork, n); err != nil {
+				return 0, err
+			}
+		}
+		end = i
+	}
+	return workBuffOffset + end, nil
+}
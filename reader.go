@@ -9,13 +9,27 @@ For example, to read compressed data from a buffer:
 	r, err := blast.NewReader(&b)
 	io.Copy(os.Stdout, r)
 	r.Close()
+
+Malformed or truncated input never causes a panic, reading it returns
+a *DecodeError wrapping ErrHeader, ErrDictionary, ErrInvalidCode,
+ErrDistanceTooFar or ErrUnexpectedEOF instead. Data rejected by the
+options of NewReaderOptions is reported the same way, with a *DecodeError
+wrapping ErrOutputLimit, ErrSizeMismatch or ErrChecksum.
+
+The amount of data decompressed from untrusted input can be limited
+with the MaxOutputSize and MaxExpansionRatio options of NewReaderOptions.
 */
 package blast
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"sync"
 )
 
 /*
@@ -58,42 +72,306 @@ import (
  * which decompresses to "AIAIAIAIAIAIA" (without the quotes).
  */
 
+// The errors found in the compressed data, including ErrOutputLimit,
+// ErrSizeMismatch and ErrChecksum, are returned wrapped in a *DecodeError
+// giving their position, and are tested for with errors.Is.
+// ErrInvalidOption is returned unwrapped by NewReaderOptions.
 var (
 	// ErrHeader is returned when reading data that has an invalid header.
 	ErrHeader = errors.New("blast: invalid header")
 	// ErrDictionary is returned when reading data that has an invalid dictionary.
 	ErrDictionary = errors.New("blast: invalid dictionary")
-	// ErrDistanceTooFar is returned when reading data that has an invalid repetition length.
+	// ErrInvalidCode is returned when reading data that has a code that is not
+	// in the literal, length or distance code tables.
+	ErrInvalidCode = errors.New("blast: invalid code")
+	// ErrDistanceTooFar is returned when reading data that has a repetition
+	// distance pointing before the beginning of the output.
 	ErrDistanceTooFar = errors.New("distance is too far back")
-	// ErrUnexpectedEOF means that EOF was encountered
+	// ErrUnexpectedEOF means that EOF was encountered before the end code,
+	// the compressed data is truncated.
 	ErrUnexpectedEOF = errors.New("unexpected EOF")
+	// ErrOutputLimit is returned when decompressing would exceed the maximum
+	// output size or expansion ratio set with MaxOutputSize or MaxExpansionRatio.
+	ErrOutputLimit = errors.New("blast: output limit exceeded")
+	// ErrSizeMismatch is returned when reading data that decompresses to
+	// more or fewer bytes than the size set with ExpectedSize.
+	ErrSizeMismatch = errors.New("blast: decompressed size does not match expected size")
+	// ErrChecksum is returned when reading data whose checksum does not
+	// match the one set with ExpectedChecksum.
+	ErrChecksum = errors.New("blast: invalid checksum")
+	// ErrInvalidOption is returned by NewReaderOptions for an invalid option value.
+	ErrInvalidOption = errors.New("blast: invalid option")
 )
 
+// A Token identifies the part of the compressed stream that was being decoded.
+type Token int
+
+const (
+	// TokenHeader is the two byte stream header.
+	TokenHeader Token = iota
+	// TokenFlag is the bit that tells whether a literal or a length/distance pair follows.
+	TokenFlag
+	// TokenLiteral is a coded or uncoded literal byte.
+	TokenLiteral
+	// TokenLength is the length of a length/distance pair, or the end code.
+	TokenLength
+	// TokenDistance is the distance of a length/distance pair.
+	TokenDistance
+)
+
+var tokenNames = []string{"header", "flag", "literal", "length", "distance"}
+
+func (t Token) String() string {
+	if t < 0 || int(t) >= len(tokenNames) {
+		return fmt.Sprintf("Token(%d)", int(t))
+	}
+	return tokenNames[t]
+}
+
+// A DecodeError reports where in the compressed data decoding failed.
+// It wraps one of ErrHeader, ErrDictionary, ErrInvalidCode, ErrDistanceTooFar,
+// ErrUnexpectedEOF, ErrOutputLimit, ErrSizeMismatch or ErrChecksum, so it can
+// be tested for with errors.Is.
+// A truncated stream also matches io.ErrUnexpectedEOF.
+type DecodeError struct {
+	Offset  int64 // offset in bits in the compressed data at which the error was found
+	Written int64 // number of decompressed bytes produced before the error
+	Token   Token // part of the stream that was being decoded
+	Err     error // the underlying error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v (decoding %v at bit offset %d, %d bytes written)", e.Err, e.Token, e.Offset, e.Written)
+}
+
+// Unwrap returns the underlying error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether a truncated stream error is compared to io.ErrUnexpectedEOF.
+func (e *DecodeError) Is(target error) bool {
+	return target == io.ErrUnexpectedEOF && e.Err == ErrUnexpectedEOF
+}
+
 const (
 	maxBits       = 13   // maximum code length
 	maxWindowSize = 4096 // maximum window size
+	maxTokenBits  = 30   // maximum length of a literal or length/distance pair
 )
 
 // input and output state
 type state struct {
 	// input state
-	reader  io.Reader // input function provided by user
-	left    int       // available input at in
+	reader  io.Reader     // input function provided by user
+	byter   io.ByteReader // reader as an io.ByteReader, if it is one
+	left    int           // available input at in
 	in      []byte
 	inIndex int
-	bitbuf  int  // bit buffer
-	bitcnt  uint // number of bits in bit buffer
+	inCount int64  // number of bytes loaded into in so far
+	bitbuf  uint64 // bit buffer
+	bitcnt  uint   // number of bits in bit buffer
+	token   Token  // part of the stream being decoded, for errors
+
+	// decoder state, kept between calls to decompress()
+	lit        int  // true if literals are coded
+	dict       int  // log2(dictionary size) - 6
+	copyLength int  // bytes left to copy of an interrupted match
+	dist       uint // distance of an interrupted match
 
 	// output state
-	writer io.Writer           // output function provided by user
-	next   uint                // index of next write location in out[]
-	first  bool                // true to check distances (for first 4K)
-	out    [maxWindowSize]byte // output buffer and sliding window
+	next      uint                // index of next write location in out[]
+	first     bool                // true to check distances (for first 4K)
+	preset    uint                // number of preset dictionary bytes at the end of out
+	out       [maxWindowSize]byte // output buffer and sliding window
+	outCount  int64               // number of bytes written before out[0]
+	memberOut int64               // number of bytes written before the current member
+
+	opts readerOptions // options set by NewReaderOptions, kept by Reset
+}
+
+// reader options, zero values are the defaults
+type readerOptions struct {
+	maxOutput int64           // maximum number of decompressed bytes, 0 for no limit
+	maxRatio  int64           // maximum ratio of decompressed to compressed bytes, 0 for no limit
+	ctx       context.Context // checked once per window, nil if not cancelable
+	dict      []byte          // preset dictionary, at most maxWindowSize bytes
+	sized     bool            // true if the size of each member is expected
+	expected  int64           // expected number of decompressed bytes of each member
+	checksum  hash.Hash32     // checksum of the decompressed bytes of each member, nil if not checked
+	sum       uint32          // expected checksum of each member
+}
+
+/*
+ * Wrap an error in the compressed data with the position in the stream s.
+ * Errors from the input and output functions are returned unchanged.
+ */
+func decodeError(s *state, err error) error {
+	switch err {
+	case ErrHeader, ErrDictionary, ErrInvalidCode, ErrDistanceTooFar, ErrUnexpectedEOF,
+		ErrOutputLimit, ErrSizeMismatch, ErrChecksum:
+		return &DecodeError{
+			Offset:  (s.inCount-int64(s.left))*8 - int64(s.bitcnt),
+			Written: s.outCount + int64(s.next),
+			Token:   s.token,
+			Err:     err,
+		}
+	}
+	return err
+}
+
+/*
+ * Return the position in the window up to which output can be written
+ * without exceeding the output limits, given the input consumed so far with
+ * bitcnt bits in the bit buffer.  The ratio limit grows as input is consumed,
+ * so the limit is checked again before the output is found to be too large.
+ */
+func outputLimit(s *state, bitcnt uint) uint {
+	limit := int64(1 << 16) // more than a window and a match
+	if s.opts.maxOutput != 0 && s.opts.maxOutput-s.outCount < limit {
+		limit = s.opts.maxOutput - s.outCount
+	}
+	if s.opts.sized && s.opts.expected-(s.outCount-s.memberOut) < limit {
+		limit = s.opts.expected - (s.outCount - s.memberOut)
+	}
+	in := s.inCount - int64(s.left) - int64(bitcnt>>3)
+	if s.opts.maxRatio != 0 && in < (1<<62)/s.opts.maxRatio {
+		if ratio := s.opts.maxRatio*in - s.outCount; ratio < limit {
+			limit = ratio
+		}
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	return uint(limit)
+}
+
+/*
+ * Return the error for output up to end in the window that is beyond the
+ * limit, ErrSizeMismatch if it is beyond the expected size.
+ */
+func limitError(s *state, end uint) error {
+	if s.opts.sized && s.outCount-s.memberOut+int64(end) > s.opts.expected {
+		return ErrSizeMismatch
+	}
+	return ErrOutputLimit
+}
+
+/*
+ * Return whether the window is full.  Once the expected size has been
+ * decompressed, only the end code can follow, and it is decoded even if
+ * the window is full, so that no more input is needed after it.
+ */
+func full(s *state) bool {
+	return s.next == maxWindowSize && !(s.opts.sized && s.outCount-s.memberOut+maxWindowSize == s.opts.expected)
+}
+
+/*
+ * Finish the stream at the end code, which is an error if the expected
+ * size has not been decompressed.
+ */
+func endCode(s *state) error {
+	align(s)
+	if s.opts.sized && s.outCount-s.memberOut+int64(s.next) != s.opts.expected {
+		return ErrSizeMismatch
+	}
+	return io.EOF
+}
+
+/*
+ * Load more input into s.in.  A source that has no more data before the
+ * end code has been decoded means the compressed stream was truncated.
+ * An io.ByteReader source is read one byte at a time, so that no input
+ * is consumed past the end code.  Otherwise the whole bytes still in the
+ * bit buffer are kept just before the new data, so that they can be
+ * given back by align() at the end code.  Without a source, all of the
+ * input was in s.in from the start.
+ */
+func fill(s *state) error {
+	var err error
+	if s.reader == nil {
+		return ErrUnexpectedEOF
+	}
+	if s.byter != nil {
+		s.in[0], err = s.byter.ReadByte()
+		s.inIndex = 0
+		if err == nil {
+			s.left = 1
+			s.inCount++
+			return nil
+		}
+		if err == io.EOF {
+			return ErrUnexpectedEOF
+		}
+		return err
+	}
+	kept := int(s.bitcnt >> 3)
+	copy(s.in[:kept], s.in[s.inIndex-kept:s.inIndex])
+	s.left, err = s.reader.Read(s.in[kept:])
+	s.inIndex = kept
+	s.inCount += int64(s.left)
+	if s.left > 0 {
+		return nil // a read error will be reported again by the next Read
+	}
+	if err == nil || err == io.EOF {
+		return ErrUnexpectedEOF
+	}
+	return err
+}
+
+/*
+ * Load as many whole bytes into the bit buffer as fit in it, eight bytes
+ * at a time.  There must be at least eight bytes of input available.  The
+ * bits above bitcnt are cleared, so that the bit buffer can still be
+ * loaded one byte at a time after that.
+ */
+func refill(s *state) {
+	n := (63 - s.bitcnt) >> 3
+	s.bitbuf |= binary.LittleEndian.Uint64(s.in[s.inIndex:]) << s.bitcnt
+	s.bitcnt += n << 3
+	s.bitbuf &= 1<<s.bitcnt - 1
+	s.inIndex += int(n)
+	s.left -= int(n)
+}
+
+// load input into the bit buffer until it holds at least need bits
+func load(s *state, need uint) error {
+	for s.bitcnt < need {
+		if s.left >= 8 {
+			refill(s)
+			continue
+		}
+		if s.left == 0 {
+			if err := fill(s); err != nil {
+				return err
+			}
+		}
+		s.bitbuf |= uint64(s.in[s.inIndex]) << s.bitcnt // load eight bits
+		s.inIndex++
+		s.left--
+		s.bitcnt += 8
+	}
+	return nil
+}
+
+/*
+ * Drop the bits left in the last byte of the stream at the end code, and
+ * give the whole bytes still in the bit buffer back to the input, since they
+ * were never part of the stream.
+ */
+func align(s *state) {
+	n := int(s.bitcnt >> 3)
+	s.inIndex -= n
+	s.left += n
+	s.bitbuf = 0
+	s.bitcnt = 0
 }
 
 /*
- * Return need bits from the input stream.  This always leaves less than
- * eight bits in the buffer.  bits() works properly for need == 0.
+ * Return need bits from the input stream.  bits() works properly for
+ * need == 0.  Input is loaded into the bit buffer several bytes at a time
+ * when possible, see refill(), so there may be more than eight bits left
+ * in the buffer.
  *
  * Format notes:
  *
@@ -103,41 +381,26 @@ type state struct {
  *   bit buffer, using shift left.
  */
 func bits(s *state, need uint) (int, error) {
-	var val int // bit accumulator
-	var err error
-	// load at least need bits into val
-	val = s.bitbuf
-	for s.bitcnt < need {
-		if s.left == 0 {
-			s.left, err = s.reader.Read(s.in)
-			s.inIndex = 0
-			if err != nil {
-				return 0, err
-			}
-			if s.left == 0 {
-				return 0, ErrUnexpectedEOF
-			}
+	// load at least need bits into the bit buffer
+	if s.bitcnt < need {
+		if err := load(s, need); err != nil {
+			return 0, err
 		}
-		val |= int(uint(s.in[s.inIndex]) << s.bitcnt) // load eight bits
-		s.inIndex++
-		s.left--
-		s.bitcnt += 8
 	}
 
-	// drop need bits and update buffer, always zero to seven bits left
-	s.bitbuf = val >> need
+	// return need bits, and drop them from the buffer
+	val := s.bitbuf & (1<<need - 1)
+	s.bitbuf >>= need
 	s.bitcnt -= need
-
-	// return need bits, zeroing the bits above that
-	return val & ((1 << need) - 1), nil
+	return int(val), nil
 }
 
 /*
- * Huffman code decoding tables.  count[1..maxBits] is the number of symbols of
+ * Huffman code tables.  count[1..maxBits] is the number of symbols of
  * each length, which for a canonical code are stepped through in order.
  * symbol[] are the symbol values in canonical order, where the number of
- * entries is the sum of the counts in count[].  The decoding process can be
- * seen in the function decode() below.
+ * entries is the sum of the counts in count[].  The lookup tables used by
+ * decode() are built from them by build().
  */
 type huffman struct {
 	count  []int16 // number of symbols of each length
@@ -145,75 +408,118 @@ type huffman struct {
 }
 
 /*
- * Decode a code from the stream s using huffman table h.  Return the symbol or
- * a negative value if there is an error.  If all of the lengths are zero, i.e.
- * an empty code, or if the code is incomplete and an invalid code is received,
- * then -9 is returned after reading maxBits bits.
- *
- * Format notes:
- *
- * - The codes as stored in the compressed data are bit-reversed relative to
- *   a simple integer ordering of codes of the same lengths.  Hence below the
- *   bits are pulled from the compressed data one at a time and used to
- *   build the code value reversed from what is in the stream in order to
- *   permit simple integer comparisons for decoding.
- *
- * - The first code for the shortest length is all ones.  Subsequent codes of
- *   the same length are simply integer decrements of the previous code.  When
- *   moving up a length, a one bit is appended to the code.  For a complete
- *   code, the last code of the longest length will be all zeros.  To support
- *   this ordering, the bits pulled during decoding are inverted to apply the
- *   more "natural" ordering starting with all zeros and incrementing.
+ * Lookup tables for decoding a Huffman code several bits at a time.  The next
+ * lookupBits bits of the stream, in stream order, index the primary table.
+ * Each entry holds the symbol in its upper bits and the code length in its
+ * low four bits.  Codes longer than lookupBits share a primary entry per
+ * prefix, with the link flag set and the offset of an overflow table in the
+ * upper bits instead of the symbol.  The overflow table is indexed by the next
+ * maxBits - lookupBits bits.  An entry of zero is not a valid code.
  */
-func decode(s *state, h *huffman) (int16, error) {
-	length := uint(1)     // current number of bits in code
-	code := 0             // length bits being decoded
-	first := 0            // first code of length length
-	var count int         // number of codes of length length
-	index := 0            // index of first code of length length in symbol table
-	bitBuffer := s.bitbuf // bits from stream
-	left := s.bitcnt      // bits left in next or left to process
-	nextIndex := 1
-	for {
-		for ; left != 0; left-- {
-			code |= (bitBuffer & 1) ^ 1 // invert code
-			bitBuffer >>= 1
-			count = int(h.count[nextIndex])
-			nextIndex++
-			if code < first+count { // if length length, return symbol
-				s.bitbuf = bitBuffer
-				s.bitcnt = (s.bitcnt - length) & 7
-				return h.symbol[index+(code-first)], nil
-			}
-			index += count // else update for next length
-			first += count
-			first <<= 1
-			code <<= 1
-			length++
-		}
-		left = (maxBits + 1) - length
-		if left == 0 {
-			break
-		}
-		if s.left == 0 {
-			var err error
-			s.left, err = s.reader.Read(s.in)
-			s.inIndex = 0
-			if err != nil {
-				return -1, err
+const (
+	lookupBits    = 8                    // bits decoded by the primary table
+	overflowBits  = maxBits - lookupBits // bits decoded by an overflow table
+	lookupLink    = 0x10                 // entry is a link to an overflow table
+	lookupLenMask = 0x0f                 // code length in an entry
+)
+
+type lookup struct {
+	primary  [1 << lookupBits]uint32
+	overflow []uint32
+}
+
+// return the entry for the code at the bottom of bitbuf
+func (t *lookup) entry(bitbuf uint64) uint32 {
+	entry := t.primary[bitbuf&(1<<lookupBits-1)]
+	if entry&lookupLink != 0 {
+		entry = t.overflow[entry>>8+uint32(bitbuf>>lookupBits)&(1<<overflowBits-1)]
+	}
+	return entry
+}
+
+/*
+ * Build the lookup tables t from the canonical Huffman code h.  The symbols
+ * are stepped through in canonical order as in the bit-by-bit decoding of
+ * blast.c: the first code of each length follows the last code of the
+ * previous length with a zero appended, codes of a length are consecutive,
+ * and the code bits are inverted in the stream.  The stream bits are read
+ * from the least significant bit up, so each code is reversed to get the
+ * table index.
+ */
+func build(t *lookup, h *huffman) {
+	code := 0  // current code, in decoding order
+	index := 0 // index of the current symbol in h.symbol
+	for length := uint(1); length <= maxBits; length++ {
+		for count := h.count[length]; count != 0; count-- {
+			// reverse the inverted code to get the stream bits
+			stream := uint(0)
+			for bit := uint(0); bit < length; bit++ {
+				stream |= uint((code>>bit)&1^1) << (length - 1 - bit)
 			}
-			if s.left == 0 {
-				return 0, ErrUnexpectedEOF
+			entry := uint32(h.symbol[index])<<8 | uint32(length)
+			if length <= lookupBits {
+				for fill := stream; fill < 1<<lookupBits; fill += 1 << length {
+					t.primary[fill] = entry
+				}
+			} else {
+				prefix := stream & (1<<lookupBits - 1)
+				if t.primary[prefix] == 0 {
+					t.primary[prefix] = uint32(len(t.overflow))<<8 | lookupLink
+					t.overflow = append(t.overflow, make([]uint32, 1<<overflowBits)...)
+				}
+				sub := t.overflow[t.primary[prefix]>>8:]
+				for fill := stream >> lookupBits; fill < 1<<overflowBits; fill += 1 << (length - lookupBits) {
+					sub[fill] = entry
+				}
 			}
+			code++
+			index++
 		}
-		bitBuffer = int(s.in[s.inIndex])
-		s.inIndex++
-		s.left--
-		if left > 8 {
-			left = 8
+		code <<= 1
+	}
+}
+
+/*
+ * Decode a code from the stream s using lookup table t.  Return the symbol or
+ * an error.  If the code is incomplete and an invalid code is received, then
+ * ErrInvalidCode is returned after reading maxBits bits.  The code is resolved
+ * from the bit buffer if it holds enough bits, which it normally does after
+ * refill(), otherwise decodeMore() loads more input.
+ */
+func decode(s *state, t *lookup) (int16, error) {
+	entry := t.entry(s.bitbuf)
+	length := uint(entry & lookupLenMask)
+	if length == 0 || length > s.bitcnt {
+		return decodeMore(s, t)
+	}
+	s.bitbuf >>= length
+	s.bitcnt -= length
+	return int16(entry >> 8), nil
+}
+
+/*
+ * Decode a code that could not be resolved from the bits in the bit buffer.
+ * Input is loaded one byte at a time, only when the bits in the bit buffer
+ * are not enough to resolve the code, so that with an io.ByteReader source
+ * no input is read past the end code.
+ */
+func decodeMore(s *state, t *lookup) (int16, error) {
+	for {
+		entry := t.entry(s.bitbuf)
+		length := uint(entry & lookupLenMask)
+		if length != 0 && length <= s.bitcnt {
+			s.bitbuf >>= length
+			s.bitcnt -= length
+			return int16(entry >> 8), nil
+		}
+		if length == 0 && s.bitcnt >= maxBits {
+			return -9, ErrInvalidCode // ran out of codes
+		}
+		// load eight more bits
+		if err := load(s, s.bitcnt+8); err != nil {
+			return -1, err
 		}
 	}
-	return -9, nil // ran out of codes
 }
 
 /*
@@ -228,9 +534,9 @@ func decode(s *state, h *huffman) (int16, error) {
  * subscribed code set, and positive for an incomplete code set.  The tables
  * can be used if the return value is zero or positive, but they cannot be used
  * if the return value is negative.  If the return value is zero, it is not
- * possible for decode() using that table to return an error--any stream of
+ * possible for decode() using a table built from it to return an error--any stream of
  * enough bits will resolve to a symbol.  If the return value is positive, then
- * it is possible for decode() using that table to return an error for received
+ * it is possible for decode() using a table built from it to return an error for received
  * codes past the end of the incomplete lengths.
  */
 func construct(h *huffman, rep []byte) int {
@@ -293,7 +599,11 @@ func construct(h *huffman, rep []byte) int {
 }
 
 /*
- * Decode PKWare Compression Library stream.
+ * Decode PKWare Compression Library stream.  Decoding stops when the output
+ * window is full, in which case nil is returned and decompress() resumes where
+ * it left off once the window has been emptied, or at the end code, in which
+ * case io.EOF is returned.  The stream header must already have been read by
+ * start().
  *
  * Format notes:
  *
@@ -331,78 +641,60 @@ func construct(h *huffman, rep []byte) int {
  *   this correctly.
  */
 func decompress(s *state) error {
-	var lit int        // true if literals are coded
-	var dict int       // log2(dictionary size) - 6
-	var symbol int16   // decoded symbol, extra bits for distance
-	var copyLength int // length for copy
-	var dist uint      // distance for copy
-
-	var copy int                                                         // copy counter
-	literalCode := huffman{make([]int16, maxBits+1), make([]int16, 256)} // length code
-	lengthCode := huffman{make([]int16, maxBits+1), make([]int16, 16)}   // length code
-	distanceCode := huffman{make([]int16, maxBits+1), make([]int16, 64)} // distance code
-	// bit lengths of literal codes
-	var literalBitLength = []byte{
-		11, 124, 8, 7, 28, 7, 188, 13, 76, 4, 10, 8, 12, 10, 12, 10, 8, 23, 8,
-		9, 7, 6, 7, 8, 7, 6, 55, 8, 23, 24, 12, 11, 7, 9, 11, 12, 6, 7, 22, 5,
-		7, 24, 6, 11, 9, 6, 7, 22, 7, 11, 38, 7, 9, 8, 25, 11, 8, 11, 9, 12,
-		8, 12, 5, 38, 5, 38, 5, 11, 7, 5, 6, 21, 6, 10, 53, 8, 7, 24, 10, 27,
-		44, 253, 253, 253, 252, 252, 252, 13, 12, 45, 12, 45, 12, 61, 12, 45,
-		44, 173}
-	// bit lengths of length codes 0..15
-	var lengthBitLength = []byte{2, 35, 36, 53, 38, 23}
-	// bit lengths of distance codes 0..63
-	var distanceBitLength = []byte{2, 20, 53, 230, 247, 151, 248}
-	var base = []int16{ // base for length codes
-		3, 2, 4, 5, 6, 7, 8, 9, 10, 12, 16, 24, 40, 72, 136, 264}
-	var extra = []int8{ // extra bits for length codes
-		0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
-
-	// set up decoding tables (once--might not be thread-safe)
-	construct(&literalCode, literalBitLength)
-	construct(&lengthCode, lengthBitLength)
-	construct(&distanceCode, distanceBitLength)
+	var symbol int16 // decoded symbol, extra bits for distance
 	var err error
-	// read header
-	lit, err = bits(s, 8)
-	if err != nil {
-		return err
-	}
-	if lit > 1 {
-		return ErrHeader
-	}
-	dict, err = bits(s, 8)
-	if err != nil {
-		return err
-	}
-	if dict < 4 || dict > 6 {
-		return ErrDictionary
+	var bitVal int
+
+	// stop if the context is done, once per window; every token decoded
+	// writes to the window, or ends decoding with the end code or an
+	// error, so the window is always filled and the context checked again
+	if s.opts.ctx != nil {
+		select {
+		case <-s.opts.ctx.Done():
+			return s.opts.ctx.Err()
+		default:
+		}
 	}
-	// decode literals and length/distance pairs
-	for {
-		bitVal, err := bits(s, 1)
+
+	// finish a copy that was interrupted by a full window
+	copyMatch(s)
+
+	// decode literals and length/distance pairs until the window is full
+	for !full(s) {
+		// decode from the bit buffer while there is enough input for it,
+		// and one token at a time as the input runs out
+		if err = decodeFast(s); err != nil {
+			return err
+		}
+		if full(s) {
+			break
+		}
+		s.token = TokenFlag
+		bitVal, err = bits(s, 1)
 		if err != nil {
 			return err
 		}
 		if bitVal != 0 {
 			// get length
+			s.token = TokenLength
 			symbol, err = decode(s, &lengthCode)
 			if err != nil {
 				return err
 			}
-			bitVal, err = bits(s, uint(extra[symbol]))
+			bitVal, err = bits(s, uint(lengthExtra[symbol]))
 			if err != nil {
 				return err
 			}
-			copyLength = int(base[symbol]) + bitVal
+			copyLength := int(lengthBase[symbol]) + bitVal
 			if copyLength == 519 {
-				break // end code
+				return endCode(s)
 			}
 			// get distance
+			s.token = TokenDistance
 			if copyLength == 2 {
 				symbol = 2
 			} else {
-				symbol = int16(dict)
+				symbol = int16(s.dict)
 			}
 			var decodeVal int16
 			decodeVal, err = decode(s, &distanceCode)
@@ -410,48 +702,27 @@ func decompress(s *state) error {
 				return err
 			}
 
-			dist = uint(decodeVal) << uint(symbol)
+			dist := uint(decodeVal) << uint(symbol)
 			bitVal, err = bits(s, uint(symbol))
 			if err != nil {
 				return err
 			}
 			dist += uint(bitVal)
 			dist++
-			if s.first && dist > s.next {
+			if s.first && dist > s.next+s.preset {
 				return ErrDistanceTooFar // distance too far back
 			}
-			// copy length bytes from distance bytes back
-			for ok := true; ok; ok = copyLength != 0 {
-				to := s.next
-				from := s.next - dist
-				copy = maxWindowSize
-				if s.next < dist {
-					from += uint(copy)
-					copy = int(dist)
-				}
-				copy -= int(s.next)
-				if copy > copyLength {
-					copy = copyLength
-				}
-				copyLength -= copy
-				s.next += uint(copy)
-				for ; copy != 0; copy-- {
-					s.out[to] = s.out[from]
-					to++
-					from++
-				}
-				if s.next == maxWindowSize {
-					_, err := s.writer.Write(s.out[:s.next])
-					if err != nil {
-						return err
-					}
-					s.next = 0
-					s.first = false
-				}
+			if s.next+uint(copyLength) > outputLimit(s, s.bitcnt) {
+				return limitError(s, s.next+uint(copyLength))
 			}
+			// copy length bytes from distance bytes back
+			s.copyLength = copyLength
+			s.dist = dist
+			copyMatch(s)
 		} else {
 			// get literal and write it
-			if lit != 0 {
+			s.token = TokenLiteral
+			if s.lit != 0 {
 				symbol, err = decode(s, &literalCode)
 				if err != nil {
 					return err
@@ -464,85 +735,652 @@ func decompress(s *state) error {
 					return err
 				}
 			}
+			if s.next+1 > outputLimit(s, s.bitcnt) {
+				return limitError(s, s.next+1)
+			}
 			s.out[s.next] = byte(symbol)
 			s.next++
-			if s.next == maxWindowSize {
-				_, err := s.writer.Write(s.out[:s.next])
-				if err != nil {
-					return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Decode literals and length/distance pairs from the bit buffer, as long as it
+ * holds at least maxTokenBits bits or can be refilled to that from s.in, and
+ * the window is not full.  The literal, length and distance codes are all
+ * complete, so any bits resolve to a symbol.  This is the same as the loop
+ * body of decompress(), without the checks for running out of bits, and with
+ * the bit buffer and the window position kept in local variables.
+ */
+func decodeFast(s *state) error {
+	bitbuf, bitcnt, next := s.bitbuf, s.bitcnt, s.next
+	lit, dict, first, preset := s.lit != 0, uint(s.dict), s.first, s.preset
+	limit := outputLimit(s, bitcnt)
+	for next < maxWindowSize {
+		if bitcnt < maxTokenBits {
+			if s.left < 8 {
+				break
+			}
+			n := (63 - bitcnt) >> 3
+			bitbuf |= binary.LittleEndian.Uint64(s.in[s.inIndex:]) << bitcnt
+			bitcnt += n << 3
+			bitbuf &= 1<<bitcnt - 1
+			s.inIndex += int(n)
+			s.left -= int(n)
+		}
+		flag := bitbuf & 1
+		bitbuf >>= 1
+		bitcnt--
+		if flag == 0 {
+			// get literal and write it
+			symbol := bitbuf & 0xff
+			length := uint(8)
+			if lit {
+				entry := literalCode.entry(bitbuf)
+				symbol = uint64(entry >> 8)
+				length = uint(entry & lookupLenMask)
+			}
+			bitbuf >>= length
+			bitcnt -= length
+			if next+1 > limit {
+				if limit = outputLimit(s, bitcnt); next+1 > limit {
+					s.bitbuf, s.bitcnt, s.next = bitbuf, bitcnt, next
+					return limitError(s, next+1)
 				}
-				s.next = 0
-				s.first = false
 			}
+			s.out[next] = byte(symbol)
+			next++
+			continue
+		}
+
+		// get length
+		entry := lengthCode.entry(bitbuf)
+		symbol := entry >> 8
+		bitbuf >>= entry & lookupLenMask
+		bitcnt -= uint(entry & lookupLenMask)
+		extra := uint(lengthExtra[symbol])
+		copyLength := int(lengthBase[symbol]) + int(bitbuf&(1<<extra-1))
+		bitbuf >>= extra
+		bitcnt -= extra
+		if copyLength == 519 {
+			s.bitbuf, s.bitcnt, s.next = bitbuf, bitcnt, next
+			return endCode(s)
+		}
+
+		// get distance
+		extra = dict
+		if copyLength == 2 {
+			extra = 2
+		}
+		entry = distanceCode.entry(bitbuf)
+		dist := uint(entry>>8) << extra
+		bitbuf >>= entry & lookupLenMask
+		bitcnt -= uint(entry & lookupLenMask)
+		dist += uint(bitbuf&(1<<extra-1)) + 1
+		bitbuf >>= extra
+		bitcnt -= extra
+		if first && dist > next+preset {
+			s.bitbuf, s.bitcnt, s.next = bitbuf, bitcnt, next
+			s.token = TokenDistance
+			return ErrDistanceTooFar // distance too far back
+		}
+		if next+uint(copyLength) > limit {
+			if limit = outputLimit(s, bitcnt); next+uint(copyLength) > limit {
+				s.bitbuf, s.bitcnt, s.next = bitbuf, bitcnt, next
+				return limitError(s, next+uint(copyLength))
+			}
+		}
+
+		// copy length bytes from distance bytes back
+		from := next - dist
+		if dist > next {
+			from += maxWindowSize // in the previous window
 		}
+		if int(next)+copyLength <= maxWindowSize && int(from)+copyLength <= maxWindowSize &&
+			(from <= next || from >= next+8) {
+			copyWords(&s.out, next, from, uint(copyLength))
+			next += uint(copyLength)
+			continue
+		}
+		s.next = next
+		s.copyLength = copyLength
+		s.dist = dist
+		copyMatch(s)
+		next = s.next
 	}
+	s.bitbuf, s.bitcnt, s.next = bitbuf, bitcnt, next
 	return nil
 }
 
-func blast(r io.Reader, w io.Writer, left *uint) error {
-	var s state // input/output state
-	// initialize input state
-	s.reader = r
-	if left != nil && *left != 0 {
-		s.left = int(*left)
-	} else {
-		s.left = 0
+/*
+ * Copy length bytes from out[from:] to out[to:] the way a forward copy one
+ * byte at a time does, but eight bytes at a time.  Neither range may extend
+ * past the end of the window, and the source must either be behind the
+ * destination or at least eight bytes ahead of it.  When the source overlaps
+ * the destination less than eight bytes back, the pattern it repeats is first
+ * extended to at least eight bytes.  The last word ends exactly at the end of
+ * the copy, since the bytes after it may still be needed by distances that
+ * reach back into the previous window.
+ */
+func copyWords(out *[maxWindowSize]byte, to, from, length uint) {
+	if from < to && to-from < 8 {
+		step := to - from
+		for step < 8 {
+			step += to - from
+		}
+		for end := to + step - (to - from); to < end && length != 0; length-- {
+			out[to] = out[from]
+			to++
+			from++
+		}
+		from = to - step
 	}
-	s.bitbuf = 0
-	s.bitcnt = 0
-	s.in = make([]byte, 16384)
-	// initialize output state
-	s.writer = w
-	s.next = 0
-	s.first = true
-	err := decompress(&s)
+	if length < 8 {
+		for ; length != 0; length-- {
+			out[to] = out[from]
+			to++
+			from++
+		}
+		return
+	}
+	for ; length > 8; length -= 8 {
+		binary.LittleEndian.PutUint64(out[to:], binary.LittleEndian.Uint64(out[from:]))
+		to += 8
+		from += 8
+	}
+	binary.LittleEndian.PutUint64(out[to+length-8:], binary.LittleEndian.Uint64(out[from+length-8:]))
+}
+
+/*
+ * Copy s.copyLength bytes from s.dist bytes back in the window, stopping
+ * early if the end of the window is reached.  The rest of the copy is done
+ * by the next call, once the window has been handed out and reset.  When
+ * the source and the destination do not overlap, the bytes are copied at
+ * once.  Otherwise the distance is shorter than the length, and the last
+ * dist bytes are repeated, doubling the copied pattern at each step.  Each
+ * step copies at least one byte, so the copy always ends.
+ */
+func copyMatch(s *state) {
+	for s.copyLength != 0 && s.next < maxWindowSize {
+		to := s.next
+		from := s.next - s.dist
+		chunk := uint(maxWindowSize)
+		if s.next < s.dist {
+			from += chunk
+			chunk = s.dist
+		}
+		chunk -= s.next
+		if chunk > uint(s.copyLength) {
+			chunk = uint(s.copyLength)
+		}
+		s.copyLength -= int(chunk)
+		s.next += chunk
+		if from == to {
+			continue // a whole window back, the bytes are already there
+		}
+		if from > to || to-from >= chunk {
+			copy(s.out[to:to+chunk], s.out[from:from+chunk])
+			continue
+		}
+		for end := to + chunk; to < end; {
+			to += uint(copy(s.out[to:end], s.out[from:to]))
+		}
+	}
+}
+
+// read the header and set up the decoding tables for a new stream
+func start(s *state) error {
+	var err error
+	s.token = TokenHeader
+	s.lit, err = bits(s, 8)
 	if err != nil {
 		return err
 	}
-	// return unused input
-	if left != nil {
-		*left = uint(s.left)
+	if s.lit > 1 {
+		return ErrHeader
+	}
+	s.dict, err = bits(s, 8)
+	if err != nil {
+		return err
 	}
-	// write any leftover output and update the error code if needed
-	if s.next != 0 {
-		_, err = s.writer.Write(s.out[:s.next])
-		if err != nil {
-			return err
-		}
+	if s.dict < 4 || s.dict > 6 {
+		return ErrDictionary
 	}
 	return nil
 }
 
-type reader struct {
-	data      []byte
-	readIndex int64
+// decoding tables, built once and only read after that
+var (
+	literalCode  lookup // literal code
+	lengthCode   lookup // length code
+	distanceCode lookup // distance code
+)
+
+func init() {
+	buildCode(&literalCode, literalBitLength, 256)
+	buildCode(&lengthCode, lengthBitLength, 16)
+	buildCode(&distanceCode, distanceBitLength, 64)
+}
+
+// set up the decoding table t for the compact code lengths rep of n symbols
+func buildCode(t *lookup, rep []byte, n int) {
+	h := huffman{make([]int16, maxBits+1), make([]int16, n)}
+	construct(&h, rep)
+	build(t, &h)
+}
+
+// bit lengths of literal codes
+var literalBitLength = []byte{
+	11, 124, 8, 7, 28, 7, 188, 13, 76, 4, 10, 8, 12, 10, 12, 10, 8, 23, 8,
+	9, 7, 6, 7, 8, 7, 6, 55, 8, 23, 24, 12, 11, 7, 9, 11, 12, 6, 7, 22, 5,
+	7, 24, 6, 11, 9, 6, 7, 22, 7, 11, 38, 7, 9, 8, 25, 11, 8, 11, 9, 12,
+	8, 12, 5, 38, 5, 38, 5, 11, 7, 5, 6, 21, 6, 10, 53, 8, 7, 24, 10, 27,
+	44, 253, 253, 253, 252, 252, 252, 13, 12, 45, 12, 45, 12, 61, 12, 45,
+	44, 173}
+
+// bit lengths of length codes 0..15
+var lengthBitLength = []byte{2, 35, 36, 53, 38, 23}
+
+// bit lengths of distance codes 0..63
+var distanceBitLength = []byte{2, 20, 53, 230, 247, 151, 248}
+
+// base for length codes
+var lengthBase = []int16{
+	3, 2, 4, 5, 6, 7, 8, 9, 10, 12, 16, 24, 40, 72, 136, 264}
+
+// extra bits for length codes
+var lengthExtra = []int8{
+	0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+
+// A Reader is an io.ReadCloser that reads and decompresses
+// a DCL stream from an underlying reader (see NewReader).
+type Reader struct {
+	s            state
+	readIndex    uint  // index of the next byte in s.out to be read
+	err          error // error that stopped decompression, io.EOF at the end code
+	multistream  bool  // continue with the next member at the end code
+	memberOffset int64 // offset of the current member in the compressed data
+	inputEnded   bool  // no more members follow the current one
+}
+
+// A Header describes how a DCL stream was compressed.
+type Header struct {
+	Mode           Mode           // Binary or ASCII, how literals are coded
+	DictionarySize DictionarySize // DictionarySize1024, DictionarySize2048 or DictionarySize4096
+}
+
+// ParseHeader parses the two byte header at the start of the DCL stream b.
+// Errors are reported the same way as by NewReader, as a *DecodeError
+// wrapping ErrHeader, ErrDictionary or ErrUnexpectedEOF.
+func ParseHeader(b []byte) (Header, error) {
+	err := &DecodeError{Token: TokenHeader}
+	switch {
+	case len(b) < 1:
+		err.Err = ErrUnexpectedEOF
+	case b[0] > 1:
+		err.Offset, err.Err = 8, ErrHeader
+	case len(b) < 2:
+		err.Offset, err.Err = 8, ErrUnexpectedEOF
+	case b[1] < 4 || b[1] > 6:
+		err.Offset, err.Err = 16, ErrDictionary
+	default:
+		return Header{Mode: Mode(b[0]), DictionarySize: 64 << DictionarySize(b[1])}, nil
+	}
+	return Header{}, err
+}
+
+// ReadHeader reads and parses the two byte header of the DCL stream r,
+// without decompressing any data. Only the header is read from r.
+func ReadHeader(r io.Reader) (Header, error) {
+	var b [2]byte
+	n, err := io.ReadFull(r, b[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Header{}, err
+	}
+	return ParseHeader(b[:n])
+}
+
+// NewReader creates a new Reader.
+// Reads from the returned Reader read and decompress data from r.
+// The stream header is read before NewReader returns, the rest of the
+// data is decompressed as it is read, one 4K window at a time.
+//
+// If r implements io.ByteReader, it is read one byte at a time and
+// no data past the end of the compressed stream is read from it.
+// Otherwise r is read in larger chunks, and the data read past the end
+// is available from Buffered.
+// It is the caller's responsibility to call Close on the Reader when done.
+func NewReader(r io.Reader) (*Reader, error) {
+	return NewReaderOptions(r)
+}
+
+// A ReaderOption sets an option of a Reader created by NewReaderOptions.
+type ReaderOption func(*readerOptions) error
+
+// MaxOutputSize limits the number of bytes a Reader decompresses to n.
+// Decoding stops with ErrOutputLimit before more than n bytes would be
+// produced. A limit of 0 means no limit, which is the default.
+func MaxOutputSize(n int64) ReaderOption {
+	return func(o *readerOptions) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		o.maxOutput = n
+		return nil
+	}
 }
 
-// NewReader creates a new ReadCloser.
-// Reads from the returned ReadCloser read and decompress data from r.
-// It is the caller's responsibility to call Close on the ReadCloser when done.
-func NewReader(r io.Reader) (io.ReadCloser, error) {
-	var writer bytes.Buffer
-	err := blast(r, &writer, nil)
+// MaxExpansionRatio limits the number of bytes a Reader decompresses to
+// ratio times the number of compressed bytes it has decoded so far.
+// Decoding stops with ErrOutputLimit as soon as more bytes would be
+// produced. A ratio of 0 means no limit, which is the default.
+func MaxExpansionRatio(ratio int64) ReaderOption {
+	return func(o *readerOptions) error {
+		if ratio < 0 {
+			return ErrInvalidOption
+		}
+		o.maxRatio = ratio
+		return nil
+	}
+}
+
+// ExpectedSize sets the number of bytes the stream is expected to
+// decompress to, for containers that store it next to the compressed data.
+// Decoding stops with ErrSizeMismatch as soon as more bytes would be
+// produced, or at an end code that comes before n bytes. Once n bytes have
+// been produced, only the end code is read from the input. With
+// Multistream or NextMember, each member is expected to be n bytes.
+func ExpectedSize(n int64) ReaderOption {
+	return func(o *readerOptions) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		o.sized = true
+		o.expected = n
+		return nil
+	}
+}
+
+// ExpectedChecksum sets the checksum the decompressed data is expected to
+// have, computed by h, usually NewCrc32 or NewCrc32Raw. h is reset at the
+// start of the stream, and Read returns ErrChecksum instead of io.EOF
+// after the end code if the checksum of the data is not sum. With
+// Multistream or NextMember, each member is expected to have checksum sum.
+func ExpectedChecksum(h hash.Hash32, sum uint32) ReaderOption {
+	return func(o *readerOptions) error {
+		if h == nil {
+			return ErrInvalidOption
+		}
+		o.checksum = h
+		o.sum = sum
+		return nil
+	}
+}
+
+// NewReaderOptions is like NewReader but sets the given options on
+// the Reader. The options are kept when the Reader is Reset.
+func NewReaderOptions(r io.Reader, opts ...ReaderOption) (*Reader, error) {
+	blastReader := new(Reader)
+	for _, opt := range opts {
+		if err := opt(&blastReader.s.opts); err != nil {
+			return nil, err
+		}
+	}
+	err := blastReader.Reset(r)
 	if err != nil {
 		return nil, err
 	}
-	blastReader := new(reader)
-	blastReader.data = writer.Bytes()
-	blastReader.readIndex = 0
 	return blastReader, nil
 }
 
-func (r *reader) Read(p []byte) (n int, err error) {
-	if r.readIndex >= int64(len(r.data)) {
-		err = io.EOF
-		return
+// NewReaderDict is like NewReader but decompresses with a preset
+// dictionary, for streams written by NewWriterDict with the same dict.
+// Distances that go back past the start of the data find the end of dict,
+// of which at most the last 4K bytes are used. Like the options, dict is
+// kept when the Reader is Reset, and is used for each member of a
+// multi-member input.
+func NewReaderDict(r io.Reader, dict []byte, opts ...ReaderOption) (*Reader, error) {
+	if len(dict) > maxWindowSize {
+		dict = dict[len(dict)-maxWindowSize:]
 	}
-	n = copy(p, r.data[r.readIndex:])
-	r.readIndex += int64(n)
-	return
+	dict = append([]byte(nil), dict...)
+	return NewReaderOptions(r, append(opts, func(o *readerOptions) error {
+		o.dict = dict
+		return nil
+	})...)
+}
+
+// NewReaderContext is like NewReaderOptions but decompression stops
+// when ctx is done. ctx is checked before each 4K window of output is
+// decompressed, and Read returns ctx.Err() once it is done. Like the
+// options, ctx is kept when the Reader is Reset.
+func NewReaderContext(ctx context.Context, r io.Reader, opts ...ReaderOption) (*Reader, error) {
+	return NewReaderOptions(r, append(opts, func(o *readerOptions) error {
+		o.ctx = ctx
+		return nil
+	})...)
+}
+
+// NewReaderSize is like NewReaderOptions but with ExpectedSize(n), so
+// that Read returns ErrSizeMismatch unless the stream decompresses to
+// exactly n bytes.
+func NewReaderSize(r io.Reader, n int64, opts ...ReaderOption) (*Reader, error) {
+	return NewReaderOptions(r, append(opts, ExpectedSize(n))...)
+}
+
+var bufferReaders = sync.Pool{New: func() interface{} { return new(Reader) }}
+
+// Decompress appends the decompressed form of the stream src to dst, and
+// returns the result. Errors are reported the same way as by Read, and
+// what was decompressed before the error is appended to dst. The data
+// following the end code of the stream is ignored. The input is decoded
+// from src directly, and the decoding state is reused by later calls, so
+// no memory is allocated if dst has enough spare capacity for the
+// decompressed data, for example when its size is known.
+func Decompress(dst, src []byte) ([]byte, error) {
+	r := bufferReaders.Get().(*Reader)
+	defer bufferReaders.Put(r)
+	*r = Reader{}
+	r.s.in = src
+	r.s.left = len(src)
+	r.s.inCount = int64(len(src))
+	r.s.first = true
+	r.err = decodeError(&r.s, start(&r.s))
+	for r.err == nil {
+		dst = append(dst, r.s.out[r.readIndex:r.s.next]...)
+		r.readIndex = r.s.next
+		r.decodeWindow()
+	}
+	dst = append(dst, r.s.out[r.readIndex:r.s.next]...)
+	r.s.in = nil
+	if r.err != io.EOF {
+		return dst, r.err
+	}
+	return dst, nil
+}
+
+// Resetter resets a Reader returned by NewReader to switch to a new
+// underlying reader. This permits reusing a Reader rather than allocating
+// a new one.
+type Resetter interface {
+	// Reset discards any buffered data and resets the Resetter as if it was
+	// newly initialized with the given reader.
+	Reset(r io.Reader) error
+}
+
+// Reset discards the Reader's state and makes it equivalent to the
+// result of NewReader, but reading from r instead. The buffers, the
+// options and the Multistream setting of the Reader are kept, so no memory
+// is allocated.
+func (r *Reader) Reset(src io.Reader) error {
+	in := r.s.in[:cap(r.s.in)]
+	opts := r.s.opts
+	multistream := r.multistream
+	*r = Reader{}
+	r.s.opts = opts
+	r.multistream = multistream
+
+	// initialize input state
+	r.s.reader = src
+	if byter, ok := src.(io.ByteReader); ok {
+		r.s.byter = byter
+		if len(in) < 1 {
+			in = make([]byte, 1)
+		}
+		r.s.in = in[:1]
+	} else {
+		if len(in) < 16384 {
+			in = make([]byte, 16384)
+		}
+		r.s.in = in[:16384]
+	}
+	// initialize output state
+	r.s.first = true
+	loadDict(&r.s)
+	if r.s.opts.checksum != nil {
+		r.s.opts.checksum.Reset()
+	}
+	r.err = decodeError(&r.s, start(&r.s))
+	return r.err
+}
+
+// Read reads up to len(p) decompressed bytes into p. It returns io.EOF
+// once the end code has been read and all data has been returned.
+func (r *Reader) Read(p []byte) (n int, err error) {
+	for {
+		if r.readIndex < r.s.next {
+			n = copy(p, r.s.out[r.readIndex:r.s.next])
+			r.readIndex += uint(n)
+			return n, nil
+		}
+		if r.err == io.EOF && r.multistream && !r.inputEnded {
+			r.err = r.nextMember()
+			continue
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.decodeWindow()
+	}
+}
+
+// load the preset dictionary at the end of the window, where the
+// distances that go back past the start of the output find it
+func loadDict(s *state) {
+	copy(s.out[maxWindowSize-len(s.opts.dict):], s.opts.dict)
+	s.preset = uint(len(s.opts.dict))
+}
+
+// decode the next window of output, once the current one has been read
+func (r *Reader) decodeWindow() {
+	// the window has been read, start over at its beginning
+	if r.s.next == maxWindowSize {
+		r.s.next = 0
+		r.s.first = false
+		r.s.outCount += maxWindowSize
+		r.readIndex = 0
+	}
+	start := r.s.next
+	r.err = decodeError(&r.s, decompress(&r.s))
+	if h := r.s.opts.checksum; h != nil {
+		h.Write(r.s.out[start:r.s.next])
+		if r.err == io.EOF && h.Sum32() != r.s.opts.sum {
+			r.err = decodeError(&r.s, ErrChecksum)
+		}
+	}
+}
+
+// Multistream controls whether the Reader supports multi-member input,
+// several compressed streams stored back to back, each with its own header.
+//
+// If enabled, the Reader decodes the members one after the other, as a
+// single stream of data, until the underlying reader has no more data.
+// Multistream is disabled by default: Read returns io.EOF at the end of
+// the first member, and NextMember can be used to advance to the next one.
+// The setting is kept when the Reader is Reset.
+func (r *Reader) Multistream(ok bool) {
+	r.multistream = ok
+}
+
+// NextMember advances to the next member of a multi-member input, after
+// discarding what is left of the current one. Header and MemberOffset then
+// describe the new member, and Read returns its data.
+// It returns io.EOF if there are no more members.
+func (r *Reader) NextMember() error {
+	for r.err == nil {
+		r.readIndex = r.s.next
+		r.decodeWindow()
+	}
+	if r.err != io.EOF {
+		return r.err
+	}
+	if r.inputEnded {
+		return io.EOF
+	}
+	r.err = r.nextMember()
+	return r.err
+}
+
+// start decoding the member that follows the end code of the current one
+func (r *Reader) nextMember() error {
+	s := &r.s
+	// the new member has its own window, and the bits left
+	// in the last byte of the current member are unused
+	s.outCount += int64(s.next)
+	s.memberOut = s.outCount
+	s.next = 0
+	s.first = true
+	loadDict(s)
+	if s.opts.checksum != nil {
+		s.opts.checksum.Reset()
+	}
+	s.copyLength = 0
+	s.bitbuf = 0
+	s.bitcnt = 0
+	r.readIndex = 0
+	if s.left == 0 {
+		err := fill(s)
+		if err == ErrUnexpectedEOF {
+			r.inputEnded = true
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	r.memberOffset = r.CompressedSize()
+	return decodeError(s, start(s))
+}
+
+// Header returns the header of the current member.
+func (r *Reader) Header() Header {
+	return Header{Mode: Mode(r.s.lit), DictionarySize: 64 << DictionarySize(r.s.dict)}
+}
+
+// MemberOffset returns the offset in the compressed data
+// at which the header of the current member begins.
+func (r *Reader) MemberOffset() int64 {
+	return r.memberOffset
+}
+
+// CompressedSize returns the number of bytes of compressed data that have
+// been decoded so far. Once Read has returned io.EOF, this is the exact
+// length of the compressed data, up to and including the last end code.
+func (r *Reader) CompressedSize() int64 {
+	return r.s.inCount - int64(r.s.left) - int64(r.s.bitcnt>>3)
+}
+
+// Buffered returns a reader of the data that was read from the underlying
+// reader but is not part of the compressed stream. It is only meaningful
+// once Read has returned io.EOF, and is always empty if the underlying
+// reader implements io.ByteReader. The rest of the data that follows the
+// compressed stream can be read from the underlying reader.
+func (r *Reader) Buffered() io.Reader {
+	return bytes.NewReader(r.s.in[r.s.inIndex : r.s.inIndex+r.s.left])
 }
 
-func (r *reader) Close() error {
+// Close closes the Reader. It does not close the underlying io.Reader.
+func (r *Reader) Close() error {
 	return nil
 }
@@ -2,9 +2,19 @@ package blast_test
 
 import (
 	"bytes"
-	"github.com/JoshVarga/blast"
+	"context"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/JoshVarga/blast"
 )
 
 func TestSimpleCase(t *testing.T) {
@@ -27,7 +37,7 @@ func TestInvalidHeader(t *testing.T) {
 	var testInput = []byte{0x02, 0x04, 0x82}
 	reader := bytes.NewBuffer(testInput)
 	_, err := blast.NewReader(reader)
-	if err != blast.ErrHeader {
+	if !errors.Is(err, blast.ErrHeader) {
 		t.Error("failed to reject invalid header")
 	}
 }
@@ -36,7 +46,806 @@ func TestInvalidDictionary(t *testing.T) {
 	var testInput = []byte{0x00, 0x03, 0x82}
 	reader := bytes.NewBuffer(testInput)
 	_, err := blast.NewReader(reader)
-	if err != blast.ErrDictionary {
+	if !errors.Is(err, blast.ErrDictionary) {
 		t.Error("failed to reject invalid dictionary")
 	}
 }
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// bitWriter builds binary mode streams after the header in out, with a
+// dictionary size of 1024 unless stated otherwise.
+type bitWriter struct {
+	out    []byte
+	bitbuf uint
+	bitcnt uint
+}
+
+func (b *bitWriter) bits(n, val uint) {
+	b.bitbuf |= val << b.bitcnt
+	b.bitcnt += n
+	for b.bitcnt >= 8 {
+		b.out = append(b.out, byte(b.bitbuf))
+		b.bitbuf >>= 8
+		b.bitcnt -= 8
+	}
+}
+
+func (b *bitWriter) literal(c byte) {
+	b.bits(1, 0)
+	b.bits(8, uint(c))
+}
+
+// match writes a copy of 518 bytes from dist (1..16) bytes back.
+func (b *bitWriter) match(dist uint) {
+	b.bits(1, 1)
+	b.bits(7, 0x00) // length code 15
+	b.bits(8, 254)  // extra bits, 264 + 254
+	b.bits(2, 0x03) // distance code 0
+	b.bits(4, dist-1)
+}
+
+// farMatch writes a copy of 3 or 518 bytes from 4096 bytes back, the
+// largest distance, with a dictionary size of 4096.
+func (b *bitWriter) farMatch(length uint) {
+	b.bits(1, 1)
+	if length == 3 {
+		b.bits(2, 0x03) // length code 1
+	} else {
+		b.bits(7, 0x00) // length code 15
+		b.bits(8, 254)  // extra bits, 264 + 254
+	}
+	b.bits(8, 0x00) // distance code 63
+	b.bits(6, 63)
+}
+
+func (b *bitWriter) close() []byte {
+	b.bits(1, 1)
+	b.bits(7, 0x00)
+	b.bits(8, 255) // end code, 264 + 255
+	if b.bitcnt != 0 {
+		b.bits(8-b.bitcnt, 0)
+	}
+	return b.out
+}
+
+func TestParseHeader(t *testing.T) {
+	for _, test := range []struct {
+		input  []byte
+		header blast.Header
+		err    error
+		offset int64
+	}{
+		{[]byte{0x00, 0x04, 0x82}, blast.Header{Mode: blast.Binary, DictionarySize: blast.DictionarySize1024}, nil, 0},
+		{[]byte{0x01, 0x06}, blast.Header{Mode: blast.ASCII, DictionarySize: blast.DictionarySize4096}, nil, 0},
+		{[]byte{0x02, 0x04}, blast.Header{}, blast.ErrHeader, 8},
+		{[]byte{0x00, 0x07}, blast.Header{}, blast.ErrDictionary, 16},
+		{[]byte{0x01}, blast.Header{}, blast.ErrUnexpectedEOF, 8},
+		{[]byte{}, blast.Header{}, blast.ErrUnexpectedEOF, 0},
+	} {
+		header, err := blast.ParseHeader(test.input)
+		if header != test.header || !errors.Is(err, test.err) {
+			t.Errorf("found=%+v, %v : expected=%+v, %v", header, err, test.header, test.err)
+		}
+		var decodeErr *blast.DecodeError
+		if errors.As(err, &decodeErr) && (decodeErr.Offset != test.offset || decodeErr.Token != blast.TokenHeader) {
+			t.Errorf("found=%+v : expected offset %v", decodeErr, test.offset)
+		}
+
+		// ReadHeader reads nothing past the header, and agrees with NewReader
+		source := bytes.NewReader(test.input)
+		header, err = blast.ReadHeader(source)
+		if header != test.header || !errors.Is(err, test.err) {
+			t.Errorf("found=%+v, %v : expected=%+v, %v", header, err, test.header, test.err)
+		}
+		if err == nil && source.Len() != len(test.input)-2 {
+			t.Errorf("found=%v bytes left : expected=%v", source.Len(), len(test.input)-2)
+		}
+		if _, err = blast.NewReader(bytes.NewReader(test.input)); !errors.Is(err, test.err) {
+			t.Errorf("found=%v : expected=%v", err, test.err)
+		}
+	}
+}
+
+func TestStreamingRead(t *testing.T) {
+	var data []byte
+	b := &bitWriter{out: []byte{0x00, 0x04}}
+	random := rand.New(rand.NewSource(1))
+	for len(data) < 1<<20 {
+		for i := 0; i < 16; i++ {
+			c := byte(random.Intn(256))
+			b.literal(c)
+			data = append(data, c)
+		}
+		dist := uint(random.Intn(16)) + 1
+		b.match(dist)
+		for i := 0; i < 518; i++ {
+			data = append(data, data[len(data)-int(dist)])
+		}
+	}
+	compressed := b.close()
+
+	source := &countingReader{r: bytes.NewReader(compressed)}
+	blastReader, err := blast.NewReader(source)
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	first := make([]byte, 100)
+	if _, err = io.ReadFull(blastReader, first); err != nil {
+		t.Fatalf("error decoding %v", err)
+	}
+	if source.n >= len(compressed) {
+		t.Errorf("consumed %v of %v compressed bytes to produce %v bytes", source.n, len(compressed), len(first))
+	}
+	rest, err := ioutil.ReadAll(iotest.OneByteReader(blastReader))
+	if err != nil {
+		t.Fatalf("error decoding %v", err)
+	}
+	if !bytes.Equal(append(first, rest...), data) {
+		t.Error("decoded data does not match")
+	}
+}
+
+func TestWindowWrap(t *testing.T) {
+	// matches reaching back into the previous window, in both the chunked
+	// and the byte at a time input paths
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<16)
+	for i := range data {
+		data[i] = "abcde fgh\n"[random.Intn(6)]
+	}
+	for _, dictSize := range []uint{blast.DictionarySize1024, blast.DictionarySize4096} {
+		compressed := compress(t, data, blast.ASCII, dictSize)
+		for _, source := range []io.Reader{bytes.NewReader(compressed), iotest.HalfReader(bytes.NewReader(compressed))} {
+			blastReader, err := blast.NewReader(source)
+			if err != nil {
+				t.Fatalf("error reading %v", err)
+			}
+			decoded, err := ioutil.ReadAll(blastReader)
+			if err != nil {
+				t.Fatalf("error decoding %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("decoded data does not match with dictionary size %v", dictSize)
+			}
+		}
+	}
+}
+
+// within fails the test if decode does not return in time, as it would
+// if decoding stalled.
+func within(t testing.TB, decode func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		decode()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("decoding did not finish")
+	}
+}
+
+// farStream returns a stream with matches the whole 4096 byte window
+// back, and the data it decompresses to.
+func farStream() (stream, data []byte) {
+	b := &bitWriter{out: []byte{0x00, 0x06}}
+	for i := 0; i < 4096; i++ {
+		data = append(data, "abcdefgh"[i*7%8])
+		b.literal(data[i])
+	}
+	// a short match in the second window, then a long one that
+	// crosses into the third one
+	b.farMatch(3)
+	data = append(data, data[len(data)-4096:len(data)-4093]...)
+	for i := 0; i < 4000; i++ {
+		data = append(data, "ijklmnop"[i*5%8])
+		b.literal(data[len(data)-1])
+	}
+	b.farMatch(518)
+	for i := 0; i < 518; i++ {
+		data = append(data, data[len(data)-4096])
+	}
+	return b.close(), data
+}
+
+func TestFarDistance(t *testing.T) {
+	stream, data := farStream()
+	for _, source := range []func() io.Reader{
+		func() io.Reader { return struct{ io.Reader }{bytes.NewReader(stream)} },
+		func() io.Reader { return bytes.NewReader(stream) },
+		func() io.Reader { return iotest.OneByteReader(bytes.NewReader(stream)) },
+	} {
+		var decoded []byte
+		var err error
+		within(t, func() {
+			var blastReader *blast.Reader
+			if blastReader, err = blast.NewReader(source()); err == nil {
+				decoded, err = ioutil.ReadAll(blastReader)
+			}
+		})
+		if err != nil {
+			t.Fatalf("error decoding %v", err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Error("decoded data does not match")
+		}
+	}
+	var decoded []byte
+	var err error
+	within(t, func() { decoded, err = blast.Decompress(nil, stream) })
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("found=%v from Decompress : expected the data", err)
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	var testInput = []byte{0x00, 0x04, 0x82, 0x24, 0x25, 0x8f}
+	blastReader, err := blast.NewReader(bytes.NewReader(testInput))
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	_, err = ioutil.ReadAll(blastReader)
+	if !errors.Is(err, blast.ErrUnexpectedEOF) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrUnexpectedEOF)
+	}
+	var decodeErr *blast.DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("found=%T : expected=%T", err, decodeErr)
+	}
+	if decodeErr.Offset != 48 || decodeErr.Written != 13 || decodeErr.Token != blast.TokenLength {
+		t.Errorf("found=%+v", decodeErr)
+	}
+}
+
+func TestDistanceTooFar(t *testing.T) {
+	b := &bitWriter{out: []byte{0x00, 0x04}}
+	b.literal('A')
+	b.match(2)
+	blastReader, err := blast.NewReader(bytes.NewReader(b.close()))
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	_, err = ioutil.ReadAll(blastReader)
+	if !errors.Is(err, blast.ErrDistanceTooFar) {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrDistanceTooFar)
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	stream := []byte{0x00, 0x04, 0x82, 0x24, 0x25, 0x8f, 0x80, 0x7f}
+	trailer := []byte("trailing data")
+	input := append(append([]byte{}, stream...), trailer...)
+	for _, source := range []io.Reader{
+		bytes.NewReader(input),
+		struct{ io.Reader }{bytes.NewReader(input)},
+	} {
+		blastReader, err := blast.NewReader(source)
+		if err != nil {
+			t.Fatalf("error reading %v", err)
+		}
+		decoded, err := ioutil.ReadAll(blastReader)
+		if err != nil {
+			t.Fatalf("error decoding %v", err)
+		}
+		if string(decoded) != "AIAIAIAIAIAIA" {
+			t.Errorf("found=%v : expected=%v", string(decoded), "AIAIAIAIAIAIA")
+		}
+		if blastReader.CompressedSize() != int64(len(stream)) {
+			t.Errorf("found=%v : expected=%v", blastReader.CompressedSize(), len(stream))
+		}
+		rest, err := ioutil.ReadAll(io.MultiReader(blastReader.Buffered(), source))
+		if err != nil {
+			t.Fatalf("error reading trailing data %v", err)
+		}
+		if !bytes.Equal(rest, trailer) {
+			t.Errorf("found=%q : expected=%q", rest, trailer)
+		}
+	}
+}
+
+func compress(t *testing.T, data []byte, mode, dictSize uint) []byte {
+	var b bytes.Buffer
+	w := blast.NewWriter(&b, mode, dictSize)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("error writing %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error closing %v", err)
+	}
+	return b.Bytes()
+}
+
+func TestMultistream(t *testing.T) {
+	first := compress(t, []byte("AIAIAIAIAIAIA"), blast.Binary, blast.DictionarySize1024)
+	second := compress(t, bytes.Repeat([]byte("blast "), 1000), blast.ASCII, blast.DictionarySize4096)
+	input := append(append([]byte{}, first...), second...)
+
+	blastReader, err := blast.NewReader(bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	blastReader.Multistream(true)
+	decoded, err := ioutil.ReadAll(blastReader)
+	if err != nil {
+		t.Fatalf("error decoding %v", err)
+	}
+	expected := "AIAIAIAIAIAIA" + strings.Repeat("blast ", 1000)
+	if string(decoded) != expected {
+		t.Errorf("found=%v : expected=%v", len(decoded), len(expected))
+	}
+	if blastReader.CompressedSize() != int64(len(input)) {
+		t.Errorf("found=%v : expected=%v", blastReader.CompressedSize(), len(input))
+	}
+}
+
+func TestNextMember(t *testing.T) {
+	first := compress(t, []byte("AIAIAIAIAIAIA"), blast.Binary, blast.DictionarySize1024)
+	second := compress(t, bytes.Repeat([]byte("blast "), 1000), blast.ASCII, blast.DictionarySize4096)
+	input := append(append([]byte{}, first...), second...)
+
+	blastReader, err := blast.NewReader(struct{ io.Reader }{bytes.NewReader(input)})
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	expected := blast.Header{Mode: blast.Binary, DictionarySize: blast.DictionarySize1024}
+	if blastReader.Header() != expected || blastReader.MemberOffset() != 0 {
+		t.Errorf("found=%+v at %v : expected=%+v at 0", blastReader.Header(), blastReader.MemberOffset(), expected)
+	}
+	decoded, err := ioutil.ReadAll(blastReader)
+	if err != nil || string(decoded) != "AIAIAIAIAIAIA" {
+		t.Fatalf("found=%v, %v : expected=AIAIAIAIAIAIA", string(decoded), err)
+	}
+
+	if err = blastReader.NextMember(); err != nil {
+		t.Fatalf("error reading next member %v", err)
+	}
+	expected = blast.Header{Mode: blast.ASCII, DictionarySize: blast.DictionarySize4096}
+	if blastReader.Header() != expected || blastReader.MemberOffset() != int64(len(first)) {
+		t.Errorf("found=%+v at %v : expected=%+v at %v", blastReader.Header(), blastReader.MemberOffset(), expected, len(first))
+	}
+	decoded, err = ioutil.ReadAll(blastReader)
+	if err != nil || string(decoded) != strings.Repeat("blast ", 1000) {
+		t.Fatalf("error decoding %v", err)
+	}
+
+	if err = blastReader.NextMember(); err != io.EOF {
+		t.Errorf("found=%v : expected=%v", err, io.EOF)
+	}
+}
+
+func TestReaderReset(t *testing.T) {
+	data := bytes.Repeat([]byte("blast reset "), 1000)
+	compressed := compress(t, data, blast.ASCII, blast.DictionarySize2048)
+	source := bytes.NewReader(compressed)
+	blastReader, err := blast.NewReader(source)
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	var resetter blast.Resetter = blastReader
+	decoded := make([]byte, len(data)+1)
+	allocs := testing.AllocsPerRun(10, func() {
+		source.Reset(compressed)
+		if err := resetter.Reset(source); err != nil {
+			t.Fatalf("error resetting %v", err)
+		}
+		n, err := io.ReadFull(blastReader, decoded)
+		if err != io.ErrUnexpectedEOF || !bytes.Equal(decoded[:n], data) {
+			t.Fatalf("decoded data does not match: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("found=%v allocations : expected=0", allocs)
+	}
+
+	// Multistream is kept too
+	blastReader.Multistream(true)
+	if err := blastReader.Reset(bytes.NewReader(append(append([]byte{}, compressed...), compressed...))); err != nil {
+		t.Fatalf("error resetting %v", err)
+	}
+	decoded, err = ioutil.ReadAll(blastReader)
+	if err != nil {
+		t.Fatalf("error decoding %v", err)
+	}
+	if !bytes.Equal(decoded, append(append([]byte{}, data...), data...)) {
+		t.Error("both members are not decoded after Reset")
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	data := benchmarkText(20000)
+	for _, length := range []int{0, 1, 4095, 4096, 4097, 20000} {
+		compressed := compress(t, data[:length], blast.ASCII, blast.DictionarySize2048)
+		// The data is appended to dst, and whatever follows the stream is ignored
+		decoded, err := blast.Decompress([]byte("prefix"), append(compressed, "trailing"...))
+		if err != nil {
+			t.Fatalf("length=%v: error decoding %v", length, err)
+		}
+		if !bytes.Equal(decoded, append([]byte("prefix"), data[:length]...)) {
+			t.Errorf("length=%v: decoded data does not match", length)
+		}
+	}
+
+	// Errors are the same as from Read, with the data decoded before them
+	decoded, err := blast.Decompress(nil, []byte{0x00, 0x04, 0x82, 0x24, 0x25, 0x8f})
+	var decodeErr *blast.DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Err != blast.ErrUnexpectedEOF || decodeErr.Offset != 48 || decodeErr.Written != 13 {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrUnexpectedEOF)
+	}
+	if string(decoded) != "AIAIAIAIAIAIA" {
+		t.Errorf("found=%q : expected=%q", decoded, "AIAIAIAIAIAIA")
+	}
+	if _, err := blast.Decompress(nil, []byte{0x02, 0x04}); !errors.Is(err, blast.ErrHeader) {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrHeader)
+	}
+
+	// Nothing is allocated when the decompressed size is known
+	compressed := compress(t, data, blast.Binary, blast.DictionarySize4096)
+	dst := make([]byte, 0, len(data))
+	allocs := testing.AllocsPerRun(10, func() {
+		if decoded, err = blast.Decompress(dst, compressed); err != nil {
+			t.Fatalf("error decoding %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("found=%v allocations : expected=0", allocs)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Error("decoded data does not match")
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	data := make([]byte, 100000)
+	compressed := compress(t, data, blast.Binary, blast.DictionarySize4096)
+	for _, test := range []struct {
+		opt blast.ReaderOption
+		err error
+	}{
+		{blast.MaxOutputSize(int64(len(data))), nil},
+		{blast.MaxOutputSize(int64(len(data) - 1)), blast.ErrOutputLimit},
+		{blast.MaxOutputSize(10000), blast.ErrOutputLimit},
+		{blast.MaxExpansionRatio(int64(2 * len(data) / len(compressed))), nil},
+		{blast.MaxExpansionRatio(10), blast.ErrOutputLimit},
+	} {
+		// both the whole token and the byte at a time decoding paths
+		for _, source := range []io.Reader{bytes.NewReader(compressed), iotest.OneByteReader(bytes.NewReader(compressed))} {
+			blastReader, err := blast.NewReaderOptions(source, test.opt)
+			if err != nil {
+				t.Fatalf("error reading %v", err)
+			}
+			decoded, err := ioutil.ReadAll(blastReader)
+			if !errors.Is(err, test.err) {
+				t.Errorf("found=%v : expected=%v", err, test.err)
+			}
+			if test.err == nil && len(decoded) != len(data) {
+				t.Errorf("found=%v bytes : expected=%v", len(decoded), len(data))
+			}
+		}
+	}
+
+	// matches a whole window back are limited too
+	stream, far := farStream()
+	for _, test := range []struct {
+		opt blast.ReaderOption
+		err error
+	}{
+		{blast.MaxOutputSize(int64(len(far))), nil},
+		{blast.MaxOutputSize(4098), blast.ErrOutputLimit},
+		{blast.MaxOutputSize(int64(len(far) - 1)), blast.ErrOutputLimit},
+		{blast.MaxExpansionRatio(1), nil},
+	} {
+		for _, source := range []io.Reader{bytes.NewReader(stream), iotest.OneByteReader(bytes.NewReader(stream))} {
+			blastReader, err := blast.NewReaderOptions(source, test.opt)
+			if err != nil {
+				t.Fatalf("error reading %v", err)
+			}
+			var decoded []byte
+			within(t, func() { decoded, err = ioutil.ReadAll(blastReader) })
+			if !errors.Is(err, test.err) {
+				t.Errorf("found=%v : expected=%v", err, test.err)
+			}
+			if test.err == nil && !bytes.Equal(decoded, far) {
+				t.Error("decoded data does not match")
+			}
+		}
+	}
+
+	// the limit is kept by Reset
+	blastReader, err := blast.NewReaderOptions(bytes.NewReader(compressed), blast.MaxOutputSize(10000))
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	if err = blastReader.Reset(bytes.NewReader(compressed)); err != nil {
+		t.Fatalf("error resetting %v", err)
+	}
+	decoded, err := ioutil.ReadAll(blastReader)
+	if !errors.Is(err, blast.ErrOutputLimit) || len(decoded) > 10000 {
+		t.Errorf("found=%v after %v bytes : expected=%v", err, len(decoded), blast.ErrOutputLimit)
+	}
+	// reported with its position, like the errors in the data
+	var decodeErr *blast.DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Written != int64(len(decoded)) {
+		t.Errorf("found=%#v : expected a *DecodeError after %v bytes", err, len(decoded))
+	}
+
+	if _, err = blast.NewReaderOptions(bytes.NewReader(compressed), blast.MaxOutputSize(-1)); err != blast.ErrInvalidOption {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidOption)
+	}
+}
+
+func TestExpectedSize(t *testing.T) {
+	data := benchmarkText(10000)
+	for _, length := range []int{0, 13, 4095, 4096, 8192, 10000} {
+		compressed := compress(t, data[:length], blast.ASCII, blast.DictionarySize4096)
+		for _, expected := range []int{length - 1, length, length + 1} {
+			if expected < 0 {
+				continue
+			}
+			source := bytes.NewReader(append(compressed, "trailing"...))
+			blastReader, err := blast.NewReaderSize(source, int64(expected))
+			if err != nil {
+				t.Fatalf("error reading %v", err)
+			}
+			decoded := make([]byte, length)
+			n, err := io.ReadFull(blastReader, decoded)
+			if expected < length {
+				if !errors.Is(err, blast.ErrSizeMismatch) || n > expected {
+					t.Errorf("length=%v expected=%v: found=%v after %v bytes : expected=%v", length, expected, err, n, blast.ErrSizeMismatch)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("length=%v expected=%v: error decoding %v", length, expected, err)
+			}
+			if !bytes.Equal(decoded, data[:length]) {
+				t.Errorf("length=%v expected=%v: decoded data does not match", length, expected)
+			}
+			// Once the expected size is read, so is the end code, and nothing after it
+			if expected == length && length > 0 && source.Len() != len("trailing") {
+				t.Errorf("length=%v: found=%v bytes left : expected=%v", length, source.Len(), len("trailing"))
+			}
+			n, err = blastReader.Read(make([]byte, 1))
+			if expected == length && (n != 0 || err != io.EOF) {
+				t.Errorf("length=%v: found=%v, %v at the end : expected=0, %v", length, n, err, io.EOF)
+			}
+			if expected > length && !errors.Is(err, blast.ErrSizeMismatch) {
+				t.Errorf("length=%v expected=%v: found=%v : expected=%v", length, expected, err, blast.ErrSizeMismatch)
+			}
+		}
+	}
+
+	// With several members, each one has the expected size
+	member := compress(t, data[:100], blast.Binary, blast.DictionarySize1024)
+	for _, test := range []struct {
+		input []byte
+		err   error
+	}{
+		{append(append([]byte{}, member...), member...), nil},
+		{append(append([]byte{}, member...), compress(t, data[:99], blast.Binary, blast.DictionarySize1024)...), blast.ErrSizeMismatch},
+	} {
+		blastReader, err := blast.NewReaderSize(bytes.NewReader(test.input), 100)
+		if err != nil {
+			t.Fatalf("error reading %v", err)
+		}
+		blastReader.Multistream(true)
+		if _, err = ioutil.ReadAll(blastReader); !errors.Is(err, test.err) {
+			t.Errorf("found=%v : expected=%v", err, test.err)
+		}
+	}
+
+	if _, err := blast.NewReaderSize(bytes.NewReader(member), -1); err != blast.ErrInvalidOption {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidOption)
+	}
+}
+
+func TestExpectedChecksum(t *testing.T) {
+	data := benchmarkText(10000)
+	compressed := compress(t, data, blast.ASCII, blast.DictionarySize4096)
+	for _, test := range []struct {
+		h   hash.Hash32
+		sum uint32
+		err error
+	}{
+		{blast.NewCrc32(), crc32.ChecksumIEEE(data), io.EOF},
+		{blast.NewCrc32Raw(0xFFFFFFFF), blast.Crc32(data, 0xFFFFFFFF), io.EOF},
+		{blast.NewCrc32(), crc32.ChecksumIEEE(data) ^ 1, blast.ErrChecksum},
+		{blast.NewCrc32Raw(0), blast.Crc32(data, 0xFFFFFFFF), blast.ErrChecksum},
+	} {
+		blastReader, err := blast.NewReaderOptions(bytes.NewReader(compressed), blast.ExpectedChecksum(test.h, test.sum))
+		if err != nil {
+			t.Fatalf("error reading %v", err)
+		}
+		// The checksum is checked again after Reset
+		for i := 0; i < 2; i++ {
+			if err := blastReader.Reset(bytes.NewReader(compressed)); err != nil {
+				t.Fatalf("error resetting %v", err)
+			}
+			decoded, err := ioutil.ReadAll(blastReader)
+			if test.err == io.EOF && err != nil || test.err != io.EOF && !errors.Is(err, test.err) {
+				t.Errorf("sum=%#x: found=%v : expected=%v", test.sum, err, test.err)
+			}
+			var decodeErr *blast.DecodeError
+			if test.err != io.EOF && (!errors.As(err, &decodeErr) || decodeErr.Written != int64(len(data))) {
+				t.Errorf("sum=%#x: found=%#v : expected a *DecodeError after %v bytes", test.sum, err, len(data))
+			}
+			// All of the data is returned before the error
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("sum=%#x: decoded data does not match", test.sum)
+			}
+		}
+	}
+
+	// With several members, each one has the expected checksum
+	member := compress(t, data[:100], blast.Binary, blast.DictionarySize1024)
+	other := compress(t, data[100:200], blast.Binary, blast.DictionarySize1024)
+	for _, test := range []struct {
+		input []byte
+		err   error
+	}{
+		{append(append([]byte{}, member...), member...), nil},
+		{append(append([]byte{}, member...), other...), blast.ErrChecksum},
+	} {
+		blastReader, err := blast.NewReaderOptions(bytes.NewReader(test.input), blast.ExpectedChecksum(blast.NewCrc32(), crc32.ChecksumIEEE(data[:100])))
+		if err != nil {
+			t.Fatalf("error reading %v", err)
+		}
+		blastReader.Multistream(true)
+		if _, err = ioutil.ReadAll(blastReader); !errors.Is(err, test.err) {
+			t.Errorf("found=%v : expected=%v", err, test.err)
+		}
+	}
+
+	if _, err := blast.NewReaderOptions(bytes.NewReader(member), blast.ExpectedChecksum(nil, 0)); err != blast.ErrInvalidOption {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidOption)
+	}
+}
+
+func TestReaderContext(t *testing.T) {
+	data := benchmarkText(1 << 16)
+	compressed := compress(t, data, blast.ASCII, blast.DictionarySize4096)
+	ctx, cancel := context.WithCancel(context.Background())
+	blastReader, err := blast.NewReaderContext(ctx, bytes.NewReader(compressed), blast.MaxOutputSize(int64(len(data))))
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	first := make([]byte, 100)
+	if _, err = io.ReadFull(blastReader, first); err != nil {
+		t.Fatalf("error decoding %v", err)
+	}
+	cancel()
+	// the rest of the current window is returned before the error
+	rest, err := ioutil.ReadAll(blastReader)
+	if err != context.Canceled {
+		t.Errorf("found=%v : expected=%v", err, context.Canceled)
+	}
+	if n := len(first) + len(rest); n != 4096 || !bytes.Equal(append(first, rest...), data[:n]) {
+		t.Errorf("found=%v bytes before cancellation : expected=4096", n)
+	}
+}
+
+func TestReaderContextFarDistance(t *testing.T) {
+	// the context is checked again after each window, even with matches
+	// a whole window back
+	stream, data := farStream()
+	ctx, cancel := context.WithCancel(context.Background())
+	blastReader, err := blast.NewReaderContext(ctx, bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	first := make([]byte, 4097)
+	within(t, func() { _, err = io.ReadFull(blastReader, first) })
+	if err != nil || !bytes.Equal(first, data[:4097]) {
+		t.Fatalf("found=%v : expected the first 4097 bytes", err)
+	}
+	cancel()
+	within(t, func() { _, err = ioutil.ReadAll(blastReader) })
+	if err != context.Canceled {
+		t.Errorf("found=%v : expected=%v", err, context.Canceled)
+	}
+}
+
+// FuzzReader checks that no input makes the reader panic or stall,
+// the corpus of inputs is in testdata/fuzz/FuzzReader.
+func FuzzReader(f *testing.F) {
+	f.Add([]byte{0x00, 0x04, 0x82, 0x24, 0x25, 0x8f, 0x80, 0x7f})
+	f.Add([]byte{0x01, 0x06, 0x82, 0x24, 0x25, 0x8f, 0x80, 0x7f})
+	f.Add([]byte{0x00, 0x04, 0x82, 0x24, 0x25, 0x8f})
+	f.Add([]byte{0x02, 0x04, 0x82})
+	f.Add([]byte{0x00, 0x03, 0x82})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		within(t, func() {
+			blastReader, err := blast.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(ioutil.Discard, blastReader)
+		})
+	})
+}
+
+// benchmarkText returns n bytes of text made of random words.
+func benchmarkText(n int) []byte {
+	words := strings.Fields(`the quick brown fox jumps over a lazy dog while
+		implode and explode compress data using the PKWare Data Compression
+		Library format with literals lengths distances and an end code`)
+	random := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for b.Len() < n {
+		b.WriteString(words[random.Intn(len(words))])
+		b.WriteByte(" \n"[random.Intn(2)])
+	}
+	return b.Bytes()[:n]
+}
+
+func benchmarkDecode(b *testing.B, mode uint, byteReader bool) {
+	data := benchmarkText(1 << 20)
+	var compressed bytes.Buffer
+	w := blast.NewWriter(&compressed, mode, blast.DictionarySize4096)
+	_, _ = w.Write(data)
+	_ = w.Close()
+
+	// a plain io.Reader, like a file, unless byteReader is set
+	source := bytes.NewReader(compressed.Bytes())
+	var input io.Reader = struct{ io.Reader }{source}
+	if byteReader {
+		input = source
+	}
+	blastReader, err := blast.NewReader(input)
+	if err != nil {
+		b.Fatalf("error reading %v", err)
+	}
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		source.Reset(compressed.Bytes())
+		_ = blastReader.Reset(input)
+		for err == nil {
+			_, err = blastReader.Read(buf)
+		}
+		if err != io.EOF {
+			b.Fatalf("error decoding %v", err)
+		}
+		err = nil
+	}
+}
+
+func BenchmarkDecodeBinary(b *testing.B) { benchmarkDecode(b, blast.Binary, false) }
+
+func BenchmarkDecodeASCII(b *testing.B) { benchmarkDecode(b, blast.ASCII, false) }
+
+func BenchmarkDecodeByteReader(b *testing.B) { benchmarkDecode(b, blast.ASCII, true) }
+
+// 4K sectors of an archive, each compressed on its own
+func BenchmarkDecompressSectors(b *testing.B) {
+	data := benchmarkText(1 << 20)
+	var sectors [][]byte
+	for p := data; len(p) > 0; p = p[0x1000:] {
+		sector, err := blast.Compress(nil, p[:0x1000], blast.ASCII, blast.DictionarySize4096)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sectors = append(sectors, sector)
+	}
+	dst := make([]byte, 0, 0x1000)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sector := range sectors {
+			if _, err := blast.Decompress(dst, sector); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
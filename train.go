@@ -0,0 +1,128 @@
+package blast
+
+import "sort"
+
+// Dictionary training picks segments of the samples that contain the most
+// substrings found in other samples too. The samples are split into as
+// many epochs as there are segments in the dictionary, and the best
+// segment of each epoch is chosen. The substrings of a chosen segment
+// don't count for the next ones, so that they add new content.
+const (
+	trainGramLength    = 6   // Length of the substrings counted
+	trainSegmentLength = 128 // Length of the segments chosen
+)
+
+// Returns the substring of trainGramLength bytes at b[i:] as a number.
+func trainGram(b []byte, i int) uint64 {
+	var v uint64
+	for _, c := range b[i : i+trainGramLength] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+type trainSegment struct {
+	data  []byte
+	score int
+}
+
+// TrainDictionary builds a preset dictionary for NewWriterDict and
+// NewReaderDict from samples of the data to be compressed. It contains the
+// substrings that are repeated across the most samples, with the most
+// valuable ones at its end, the shortest distance back from the data.
+// The dictionary is at most size bytes, and at most DictionarySize4096
+// bytes, as only that much of it is used. It is shorter if the samples
+// have too little in common.
+func TrainDictionary(samples [][]byte, size DictionarySize) []byte {
+	if size > DictionarySize4096 {
+		size = DictionarySize4096
+	}
+
+	// Count the samples each substring is found in
+	freq := make(map[uint64]int)
+	seen := make(map[uint64]int)
+	total := 0
+	for n, sample := range samples {
+		for i := 0; i+trainGramLength <= len(sample); i++ {
+			g := trainGram(sample, i)
+			if last, ok := seen[g]; !ok || last != n {
+				seen[g] = n
+				freq[g]++
+			}
+		}
+		total += len(sample)
+	}
+	// A substring found in a single sample is not worth keeping
+	for g, f := range freq {
+		if f < 2 {
+			delete(freq, g)
+		}
+	}
+
+	epochs := int(size) / trainSegmentLength
+	if epochs == 0 || total == 0 {
+		return nil
+	}
+	epochSize := (total + epochs - 1) / epochs
+	var segments []trainSegment
+	window := make(map[uint64]int)
+	sample, offset := 0, 0
+	for epoch := 0; epoch < epochs; epoch++ {
+		// Find the segment of the epoch whose distinct substrings are
+		// found in the most samples, without crossing samples
+		best := trainSegment{}
+		for left := epochSize; left > 0 && sample < len(samples); {
+			b := samples[sample]
+			end := offset + left
+			if end > len(b) {
+				end = len(b)
+			}
+			for k := range window {
+				delete(window, k)
+			}
+			score := 0
+			for i := offset; i+trainGramLength <= len(b) && i < end; i++ {
+				g := trainGram(b, i)
+				if window[g]++; window[g] == 1 {
+					score += freq[g]
+				}
+				// Drop the substring that leaves the segment
+				if start := i - (trainSegmentLength - trainGramLength); start > offset {
+					g := trainGram(b, start-1)
+					if window[g]--; window[g] == 0 {
+						score -= freq[g]
+					}
+				}
+				if score > best.score {
+					from := i + trainGramLength - trainSegmentLength
+					if from < 0 {
+						from = 0
+					}
+					best = trainSegment{b[from : i+trainGramLength], score}
+				}
+			}
+			left -= end - offset
+			if offset = end; offset == len(b) {
+				sample, offset = sample+1, 0
+			}
+		}
+		if best.score == 0 {
+			continue
+		}
+		for i := 0; i+trainGramLength <= len(best.data); i++ {
+			delete(freq, trainGram(best.data, i))
+		}
+		segments = append(segments, best)
+	}
+
+	// The best segments go last, where the distances are shortest
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].score < segments[j].score })
+	var dict []byte
+	for _, segment := range segments {
+		dict = append(dict, segment.data...)
+	}
+	if len(dict) > int(size) {
+		dict = dict[len(dict)-int(size):]
+	}
+	return dict
+}
@@ -0,0 +1,64 @@
+package blast_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/JoshVarga/blast"
+)
+
+func trainingSamples(n int, random *rand.Rand) [][]byte {
+	themes := []string{"dark", "light"}
+	roles := []string{"reader", "writer", "admin", "owner"}
+	samples := make([][]byte, n)
+	for i := range samples {
+		samples[i] = []byte(fmt.Sprintf(`{"id":%d,"name":"user%d","email":"user%d@example.com","role":"%s","settings":{"theme":"%s","notifications":%v}}`,
+			random.Intn(100000), i, i, roles[random.Intn(len(roles))], themes[random.Intn(len(themes))], random.Intn(2) == 0))
+	}
+	return samples
+}
+
+func TestTrainDictionary(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	samples := trainingSamples(500, random)
+	heldOut := trainingSamples(50, random)
+	compressedSize := func(dict []byte) int {
+		total := 0
+		for _, sample := range heldOut {
+			var b bytes.Buffer
+			w := blast.NewWriterDict(&b, blast.ModeAuto, blast.DictionarySizeAuto, dict)
+			if _, err := w.Write(sample); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("error closing %v", err)
+			}
+			total += b.Len()
+		}
+		return total
+	}
+	without := compressedSize(nil)
+	for _, size := range []blast.DictionarySize{blast.DictionarySize1024, blast.DictionarySize2048, blast.DictionarySize4096} {
+		dict := blast.TrainDictionary(samples, size)
+		if len(dict) == 0 || len(dict) > int(size) {
+			t.Errorf("size=%v: found=%v bytes", size, len(dict))
+		}
+		if !bytes.Equal(blast.TrainDictionary(samples, size), dict) {
+			t.Errorf("size=%v: training is not deterministic", size)
+		}
+		if with := compressedSize(dict); with*2 > without {
+			t.Errorf("size=%v: found=%v bytes with dictionary : expected at most half of %v", size, with, without)
+		}
+	}
+
+	if dict := blast.TrainDictionary(nil, blast.DictionarySize4096); len(dict) != 0 {
+		t.Errorf("found=%v bytes without samples : expected=0", len(dict))
+	}
+	// Samples with nothing in common give nothing to train on
+	unrelated := [][]byte{randomBytes(1000, 256), randomBytes(1000, 256)}
+	if dict := blast.TrainDictionary(unrelated, blast.DictionarySize4096); len(dict) != 0 {
+		t.Errorf("found=%v bytes for unrelated samples : expected=0", len(dict))
+	}
+}
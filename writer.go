@@ -1,9 +1,13 @@
 package blast
 
 import (
-	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"strconv"
+	"sync"
 )
 
 /*
@@ -33,11 +37,44 @@ import (
  * Implode function of PKWARE Data Compression library
  */
 
+// A Mode is the compression mode of a DCL stream, which tells
+// whether literals are coded, Binary or ASCII.
+type Mode uint
+
+func (m Mode) String() string {
+	switch m {
+	case Binary:
+		return "binary"
+	case ASCII:
+		return "ascii"
+	case ModeAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("Mode(%d)", uint(m))
+}
+
+// A DictionarySize is the size of the sliding dictionary of a DCL stream,
+// DictionarySize1024, DictionarySize2048 or DictionarySize4096.
+type DictionarySize uint
+
+func (d DictionarySize) String() string {
+	switch d {
+	case DictionarySize1024, DictionarySize2048, DictionarySize4096:
+		return strconv.Itoa(int(d))
+	case DictionarySizeAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("DictionarySize(%d)", uint(d))
+}
+
 const (
 	// Binary represents the Binary compression mode
 	Binary = 0
 	// ASCII represents the ASCII compression mode
 	ASCII = 1
+	// ModeAuto chooses Binary or ASCII, whichever codes the literals of
+	// the first 4K block of data in fewer bits. It is not stored in streams.
+	ModeAuto = 2
 
 	// DictionarySize1024 represents a dictiony of size 1024 is used
 	DictionarySize1024 = 1024
@@ -45,43 +82,50 @@ const (
 	DictionarySize2048 = 2048
 	// DictionarySize4096 represents a dictiony of size 4096 is used
 	DictionarySize4096 = 4096
+	// DictionarySizeAuto chooses the dictionary size with which the first
+	// 4K block of data compresses best. It is not stored in streams.
+	DictionarySizeAuto = 0
 )
 
 type tCmpStruct struct {
-	distance   uint          // 0000: Backward distance of the currently found repetition, decreased by 1
-	outBytes   uint          // 0004: # bytes available in outBuff
-	outBits    uint          // 0008: # of bits available in the last out byte
-	dsizeBits  uint          // 000C: Number of bits needed for dictionary size. 4 = 0x400, 5 = 0x800, 6 = 0x1000
-	dsizeMask  uint          // 0010: Bit mask for dictionary. 0x0F = 0x400, 0x1F = 0x800, 0x3F = 0x1000
-	cType      uint          // 0014: Compression type (ASCII or Binary)
-	dsizeBytes uint          // 0018: Dictionary size in bytes
-	distBits   []uint8       // 001C: Distance bits
-	distCodes  []uint8       // 005C: Distance codes
-	nChBits    [0x306]uint8  // 009C: Table of literal bit lengths to be put to the output stream
-	nChCodes   [0x306]uint16 // 03A2: Table of literal codes to be put to the output stream
+	distance   uint           // 0000: Backward distance of the currently found repetition, decreased by 1
+	outBytes   uint           // 0004: # bytes available in outBuff
+	outBits    uint           // 0008: # of bits available in the last out byte
+	dsizeBits  uint           // 000C: Number of bits needed for dictionary size. 4 = 0x400, 5 = 0x800, 6 = 0x1000
+	dsizeMask  uint           // 0010: Bit mask for dictionary. 0x0F = 0x400, 0x1F = 0x800, 0x3F = 0x1000
+	cType      uint           // 0014: Compression type (ASCII or Binary)
+	dsizeBytes uint           // 0018: Dictionary size in bytes
+	distBits   []uint8        // 001C: Distance bits
+	distCodes  []uint8        // 005C: Distance codes
+	nChBits    *[0x306]uint8  // 009C: Table of literal bit lengths to be put to the output stream
+	nChCodes   *[0x306]uint16 // 03A2: Table of literal codes to be put to the output stream
 	//offs09AE   uint16        // 09AE:
 
 	//param     *uint8    // 09B0: User parameter
-	readBuf  io.Reader // 9B4
 	writeBuf io.Writer // 9B8
 
-	offs09BC [0x204]uint16 // 09BC:
-	// offs0DC4     uint32        // 0DC4: unknown use
-	phashToIndex [0x900]uint16 // 0DC8: Array of indexes (one for each PAIR_HASH) to the "pair_hash_offsets" table
-	//phashToIndexEnd uint16        // 1FC8: End marker for "phashToIndex" table
 	outBuff  []uint8 // 1FCA: Compressed data
 	workBuff []uint8 // 27CC: Work buffer
 	//  + DICT_OFFSET  => Dictionary
 	//  + UNCMP_OFFSET => Uncompressed data
-	phashOffs [0x2204]uint16 // 49D0: Table of offsets for each PAIR_HASH
+
+	workBuffOffset uint            // Offset of the next byte to compress in workBuff
+	bytesLoaded    uint            // # bytes loaded into the current block, up to 0x1000
+	phase          uint            // Number of blocks compressed so far, up to 2
+	ctx            context.Context // Checked before each block is compressed, nil if not cancelable
+	level          int             // Compression level
+	finder         matchFinder     // Search for repetitions
+	parse          *optimalParse   // Work space of the search when level is MaxCompression
 }
 
 func newTCmpStruct() *tCmpStruct {
 	result := new(tCmpStruct)
-	result.workBuff = make([]uint8, 0x2204)
+	// The searches never read past the end of the loaded data, so the
+	// output doesn't depend on what is left in the rest of the buffer.
+	result.workBuff = make([]uint8, 0x2204+maxRepLength+2)
 	result.outBuff = make([]uint8, 0x802)
-	result.distBits = make([]uint8, 0x40)
-	result.distCodes = make([]uint8, 0x40)
+	result.distBits = distBits
+	result.distCodes = distCodes
 	return result
 }
 
@@ -167,62 +211,6 @@ var chCodeAscs = []uint16{
 	0x1C00, 0x0C00, 0x1400, 0x0400, 0x1800, 0x0800, 0x1000, 0x0000,
 }
 
-// calculating hash of the current byte pair.
-// Note that most exact byte pair hash would be buffer[0] + buffer[1] << 0x08,
-// but even this way gives nice indication of equal byte pairs, with significantly
-// smaller size of the array that holds numbers of those hashes
-func getBytePairHash(buffer []uint8, offset uint) uint16 {
-	return uint16(buffer[offset]*4) + uint16(buffer[offset+1]*5)
-}
-
-// Builds the "hash_to_index" table and "pair_hash_offsets" table.
-// Every element of "hash_to_index" will contain lowest index to the
-// "pair_hash_offsets" table, effectively giving offset of the first
-// occurrence of the given PAIR_HASH in the input data.
-func sortBuffer(pWork *tCmpStruct, bufferBegin uint, bufferEnd uint) {
-	var phashToIndex int
-	var bufferPtr uint
-	var totalSum = uint16(0)
-	var bytePairHash uint32 // Hash value of the byte pair
-	var bytePairOffs uint16 // Offset of the byte pair, relative to "workBuff"
-
-	// Zero the entire "phashToIndex" table
-	for m := range pWork.phashToIndex {
-		pWork.phashToIndex[m] = 0
-	}
-	// Step 1: Count amount of each PAIR_HASH in the input buffer
-	// The table will look like this:
-	//  offs 0x000: Number of occurrences of PAIR_HASH 0
-	//  offs 0x001: Number of occurrences of PAIR_HASH 1
-	//  ...
-	//  offs 0x8F7: Number of occurrences of PAIR_HASH 0x8F7 (the highest hash value)
-	for bufferPtr = bufferBegin; bufferPtr < bufferEnd; bufferPtr++ {
-		pWork.phashToIndex[getBytePairHash(pWork.workBuff, bufferPtr)]++
-	}
-	// Step 2: Convert the table to the array of PAIR_HASH amounts.
-	// Each element contains count of PAIR_HASHes that is less or equal
-	// to element index
-	// The table will look like this:
-	//  offs 0x000: Number of occurrences of PAIR_HASH 0 or lower
-	//  offs 0x001: Number of occurrences of PAIR_HASH 1 or lower
-	//  ...
-	//  offs 0x8F7: Number of occurrences of PAIR_HASH 0x8F7 or lower
-	for phashToIndex = 0; phashToIndex < len(pWork.phashToIndex); phashToIndex++ {
-		totalSum = totalSum + pWork.phashToIndex[phashToIndex]
-		pWork.phashToIndex[phashToIndex] = totalSum
-	}
-
-	// Step 3: Convert the table to the array of indexes.
-	// Now, each element contains index to the first occurrence of given PAIR_HASH
-	for bufferEnd--; bufferEnd >= bufferBegin; bufferEnd-- {
-		bytePairHash = uint32(getBytePairHash(pWork.workBuff, bufferEnd))
-		bytePairOffs = uint16(bufferEnd)
-
-		pWork.phashToIndex[bytePairHash]--
-		pWork.phashOffs[pWork.phashToIndex[bytePairHash]] = bytePairOffs
-	}
-}
-
 func flushBuf(pWork *tCmpStruct) error {
 	var saveCh1 uint8
 	var saveCh2 uint8
@@ -233,6 +221,11 @@ func flushBuf(pWork *tCmpStruct) error {
 	saveCh1 = pWork.outBuff[0x800]
 	saveCh2 = pWork.outBuff[pWork.outBytes]
 	pWork.outBytes -= 0x800
+
+	// outputBits ORs the bits into outBuff, so clear it
+	for m := range pWork.outBuff {
+		pWork.outBuff[m] = 0
+	}
 	if pWork.outBytes != 0 {
 		pWork.outBuff[0] = saveCh1
 	}
@@ -284,271 +277,63 @@ func outputBits(pWork *tCmpStruct, nBits uint16, bitBuff uint) error {
 	return nil
 }
 
-// This function searches for a repetition
-// (a previous occurrence of the current byte sequence)
-// Returns length of the repetition, and stores the backward distance
-// to pWork structure.
-func findRep(pWork *tCmpStruct, workBuffOffset uint) uint {
-	var (
-		phashToIndex    uint // Pointer into pWork.phashToIndex table
-		phashOffs       uint // Pointer to the table containing offsets of each PAIR_HASH
-		repetitionLimit int  // An eventual repetition must be at position below this pointer
-		prevRepetition  uint // Pointer to the previous occurrence of the current PAIR_HASH
-		prevRepEnd      uint // End of the previous repetition
-		inputDataPtr    uint
-		phashOffsIndex  uint      // Index to the table with PAIR_HASH positions
-		minPhashOffs    uint16    // The lowest allowed hash offset
-		offsInRep       uint16    // Offset within found repetition
-		equalByteCount  uint      // Number of bytes that are equal to the previous occurrence
-		repLength       = uint(1) // Length of the found repetition
-		repLength2      uint      // Secondary repetition
-		preLastByte     uint8     // Last but one byte from a repetition
-		diVal           uint16
-	)
-	// Calculate the previous position of the PAIR_HASH
-	phashToIndex = uint(getBytePairHash(pWork.workBuff, workBuffOffset))
-	minPhashOffs = uint16(workBuffOffset - pWork.dsizeBytes + 1)
-	phashOffsIndex = uint(pWork.phashToIndex[phashToIndex])
-
-	// If the PAIR_HASH offset is below the limit, find a next one
-	phashOffs = phashOffsIndex
-	if pWork.phashOffs[phashOffs] < minPhashOffs {
-		for pWork.phashOffs[phashOffs] < minPhashOffs {
-			phashOffsIndex++
-			phashOffs++
-		}
-		pWork.phashToIndex[phashToIndex] = uint16(phashOffsIndex)
-	}
-
-	// Get the first location of the PAIR_HASH,
-	// and thus the first eventual location of byte repetition
-	phashOffs = phashOffsIndex
-	prevRepetition = uint(pWork.phashOffs[phashOffs]) // offset to pWork.workBuff
-	repetitionLimit = int(workBuffOffset) - 1
-
-	// If the current PAIR_HASH was not encountered before,
-	// we haven't found a repetition.
-	if int(prevRepetition) >= repetitionLimit {
-		return 0
-	}
-	// We have found a match of a PAIR_HASH. Now we have to make sure
-	// that it is also a byte match, because PAIR_HASH is not unique.
-	// We compare the bytes and count the length of the repetition
-	inputDataPtr = workBuffOffset
-	for {
-		// If the first byte of the repetition and the so-far-last byte
-		// of the repetition are equal, we will compare the blocks.
-		if pWork.workBuff[inputDataPtr] == pWork.workBuff[prevRepetition] && pWork.workBuff[inputDataPtr+repLength-1] == pWork.workBuff[prevRepetition+repLength-1] {
-			// Skip the current byte
-			prevRepetition++
-			inputDataPtr++
-			equalByteCount = 2
-
-			// Now count how many more bytes are equal
-			for equalByteCount < maxRepLength {
-				prevRepetition++
-				inputDataPtr++
-
-				// Are the bytes different ?
-				if pWork.workBuff[prevRepetition] != pWork.workBuff[inputDataPtr] {
-					break
-				}
-				equalByteCount++
-			}
-
-			// If we found a repetition of at least the same length, take it.
-			// If there are multiple repetitions in the input buffer, this will
-			// make sure that we find the most recent one, which in turn allows
-			// us to store backward length in less amount of bits
-			inputDataPtr = workBuffOffset
-			if equalByteCount >= repLength {
-				// Calculate the backward distance of the repetition.
-				// Note that the distance is stored as decremented by 1
-				pWork.distance = uint(workBuffOffset - prevRepetition + equalByteCount - 1)
-
-				// Repetitions longer than 10 bytes will be stored in more bits,
-				// so they need a bit different handling
-				repLength = equalByteCount
-				if repLength > 10 {
-					break
-				}
-			}
-		}
+// Outputs the literal ch.
+func outputLiteral(pWork *tCmpStruct, ch uint8) error {
+	return outputBits(pWork, uint16(pWork.nChBits[ch]), uint(pWork.nChCodes[ch]))
+}
 
-		// Move forward in the table of PAIR_HASH repetitions.
-		// There might be a more recent occurrence of the same repetition.
-		phashOffsIndex++
-		phashOffs++
-		prevRepetition = uint(pWork.phashOffs[phashOffs])
-
-		// If the next repetition is beyond the minimum allowed repetition, we are done.
-		if int(prevRepetition) >= repetitionLimit {
-			// A repetition must have at least 2 bytes, otherwise it's not worth it
-			if repLength >= 2 {
-				return repLength
-			}
-			return 0
-		}
+// Outputs a repetition of repLength bytes, at the backward distance
+// stored in pWork.distance, decreased by 1.
+func outputRepetition(pWork *tCmpStruct, repLength uint) error {
+	err := outputBits(pWork, uint16(pWork.nChBits[repLength+0xFE]), uint(pWork.nChCodes[repLength+0xFE]))
+	if err != nil {
+		return err
 	}
-
-	// If the repetition has max length of 0x204 bytes, we can't go any fuhrter
-	if equalByteCount == maxRepLength {
-		pWork.distance--
-		return equalByteCount
-	}
-
-	// Check for possibility of a repetition that occurs at more recent position
-	phashOffs = phashOffsIndex
-	if int(pWork.phashOffs[phashOffs+1]) >= repetitionLimit {
-		return repLength
-	}
-
-	// The following part checks if there isn't a longer repetition at
-	// a latter offset, that would lead to better compression.
-	//
-	// Example of data that can trigger this optimization:
-	//
-	//   "EEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEQQQQQQQQQQQQ"
-	//   "XYZ"
-	//   "EEEEEEEEEEEEEEEEQQQQQQQQQQQQ";
-	//
-	// Description of data in this buffer
-	//   [0x00] Single byte "E"
-	//   [0x01] Single byte "E"
-	//   [0x02] Repeat 0x1E bytes from [0x00]
-	//   [0x20] Single byte "X"
-	//   [0x21] Single byte "Y"
-	//   [0x22] Single byte "Z"
-	//   [0x23] 17 possible previous repetitions of length at least 0x10 bytes:
-	//          - Repetition of 0x10 bytes from [0x00] "EEEEEEEEEEEEEEEE"
-	//          - Repetition of 0x10 bytes from [0x01] "EEEEEEEEEEEEEEEE"
-	//          - Repetition of 0x10 bytes from [0x02] "EEEEEEEEEEEEEEEE"
-	//          ...
-	//          - Repetition of 0x10 bytes from [0x0F] "EEEEEEEEEEEEEEEE"
-	//          - Repetition of 0x1C bytes from [0x10] "EEEEEEEEEEEEEEEEQQQQQQQQQQQQ"
-	//          The last repetition is the best one.
-	//
-
-	pWork.offs09BC[0] = 0xFFFF
-	pWork.offs09BC[1] = 0x0000
-	diVal = 0
-
-	// Note: I failed to figure out what does the table "offs09BC" mean.
-	// If anyone has an idea, let me know to zezula_at_volny_dot_cz
-	for offsInRep = 1; uint(offsInRep) < repLength; {
-		if pWork.workBuff[workBuffOffset+uint(offsInRep)] != pWork.workBuff[workBuffOffset+uint(diVal)] {
-			diVal = pWork.offs09BC[diVal]
-			if diVal != 0xFFFF {
-				continue
-			}
+	if repLength == 2 {
+		err = outputBits(pWork, uint16(pWork.distBits[pWork.distance>>2]), uint(pWork.distCodes[pWork.distance>>2]))
+		if err != nil {
+			return err
 		}
-		offsInRep++
-		diVal++
-		pWork.offs09BC[offsInRep] = diVal
+		return outputBits(pWork, 2, pWork.distance&3)
 	}
+	err = outputBits(pWork, uint16(pWork.distBits[pWork.distance>>pWork.dsizeBits]),
+		uint(pWork.distCodes[pWork.distance>>pWork.dsizeBits]))
+	if err != nil {
+		return err
+	}
+	return outputBits(pWork, uint16(pWork.dsizeBits), pWork.dsizeMask&pWork.distance)
+}
 
-	//
-	// Now go through all the repetitions from the first found one
-	// to the current input data, and check if any of them migh be
-	// a start of a greater sequence match.
-	//
-
-	prevRepetition = uint(pWork.phashOffs[phashOffs])
-	prevRepEnd = prevRepetition + repLength
-	repLength2 = repLength
-
-	for {
-		repLength2 = uint(pWork.offs09BC[repLength2])
-		if repLength2 == 0xFFFF {
-			repLength2 = 0
-		}
-		// Get the pointer to the previous repetition
-		phashOffs = phashOffsIndex
-
-		// Skip those repetitions that don't reach the end
-		// of the first found repetition
-		for ok := true; ok; ok = prevRepetition+repLength2 < prevRepEnd {
-			phashOffs++
-			phashOffsIndex++
-			prevRepetition = uint(pWork.phashOffs[phashOffs])
-			if int(prevRepetition) >= repetitionLimit {
-				return repLength
-			}
-		}
-
-		// Verify if the last but one byte from the repetition matches
-		// the last but one byte from the input data.
-		// If not, find a next repetition
-		preLastByte = pWork.workBuff[workBuffOffset+repLength-2]
-		if preLastByte == pWork.workBuff[prevRepetition+repLength-2] {
-			// If the new repetition reaches beyond the end
-			// of previously found repetition, reset the repetition length to zero.
-			if prevRepetition+repLength2 != prevRepEnd {
-				prevRepEnd = prevRepetition
-				repLength2 = 0
-			}
-		} else {
-			phashOffs = phashOffsIndex
-			for ok := true; ok; ok = pWork.workBuff[prevRepetition+repLength-2] != preLastByte ||
-				pWork.workBuff[prevRepetition] != pWork.workBuff[workBuffOffset] {
-				phashOffs++
-				phashOffsIndex++
-				prevRepetition = uint(pWork.phashOffs[phashOffs])
-				if int(prevRepetition) >= repetitionLimit {
-					return repLength
-				}
-			}
-
-			// Reset the length of the repetition to 2 bytes only
-			prevRepEnd = prevRepetition + 2
-			repLength2 = 2
-		}
-
-		// Find out how many more characters are equal to the first repetition.
-		for prevRepEnd == workBuffOffset+repLength2 {
-			repLength2++
-			if repLength2 >= 0x204 {
-				break
-			}
-			prevRepEnd++
-		}
-
-		// Is the newly found repetition at least as long as the previous one ?
-		if repLength2 >= repLength {
-			// Calculate the distance of the new repetition
-			pWork.distance = uint(workBuffOffset - prevRepetition - 1)
-			repLength = repLength2
-			if repLength == 0x204 {
-				return repLength
-			}
-
-			// Update the additional elements in the "offs09BC" table
-			// to reflect new rep length
-			for uint(offsInRep) < repLength2 {
-				if pWork.workBuff[workBuffOffset+uint(offsInRep)] != pWork.workBuff[workBuffOffset+uint(diVal)] {
-					diVal = pWork.offs09BC[diVal]
-					if diVal != 0xFFFF {
-						continue
-					}
-				}
-				diVal++
-				offsInRep++
-				pWork.offs09BC[offsInRep] = diVal
-			}
-		}
+// This function searches for a repetition
+// (a previous occurrence of the current byte sequence)
+// Returns length of the repetition, and stores the backward distance
+// to pWork structure. The repetition can extend up to dataEndIndex.
+func findRep(pWork *tCmpStruct, workBuffOffset uint, dataEndIndex uint) uint {
+	maxLength := dataEndIndex - workBuffOffset
+	if maxLength > maxRepLength {
+		maxLength = maxRepLength
 	}
+	repLength, distance := pWork.finder.find(pWork.workBuff, workBuffOffset, maxLength, pWork.dsizeBytes-1)
+	if repLength != 0 {
+		pWork.distance = distance - 1
+	}
+	return repLength
 }
 
-func writeCmpData(pWork *tCmpStruct) error {
-	var inputDataEndIndex uint // Pointer to the end of the input data
-	var workBuffOffset = pWork.dsizeBytes + 0x204
-	var inputDataEnded = false // If 1, then all data from the input stream have been already loaded
-	var saveRepLength uint     // Saved length of current repetition
-	var saveDistance uint      // Saved distance of current repetition
-	var repLength uint         // Length of the found repetition
-	var phase = uint(0)        //
-	var err error
+// Loads the end of dict, up to the dictionary size, into the work buffer
+// in front of the data, where repetitions can be found in it.
+func loadDictionary(pWork *tCmpStruct, dict []byte) {
+	if uint(len(dict)) > pWork.dsizeBytes {
+		dict = dict[uint(len(dict))-pWork.dsizeBytes:]
+	}
+	start := pWork.workBuffOffset - uint(len(dict))
+	copy(pWork.workBuff[start:], dict)
+	pWork.finder.reset(start)
+}
 
+// Prepares the work structure for compressing a new stream,
+// and stores the compression type and dictionary size in the output buffer.
+func startCmpData(pWork *tCmpStruct) {
 	// Store the compression type and dictionary size
 	pWork.outBuff[0] = uint8(pWork.cType)
 	pWork.outBuff[1] = uint8(pWork.dsizeBits)
@@ -562,166 +347,173 @@ func writeCmpData(pWork *tCmpStruct) error {
 	}
 	pWork.outBits = 0
 
-	for !inputDataEnded {
-		var bytesToLoad = uint(0x1000)
-		var totalLoaded = int(0)
-		var bytesLoaded int
-
-		// Load the bytes from the input stream, up to 0x1000 bytes
-		for bytesToLoad != 0 {
-			input := make([]byte, bytesToLoad)
-			bytesLoaded, _ = pWork.readBuf.Read(input)
-			copy(pWork.workBuff[pWork.dsizeBytes+0x204+uint(totalLoaded):pWork.dsizeBytes+0x204+uint(totalLoaded)+uint(bytesToLoad)], input)
-			if bytesLoaded == 0 {
-				if totalLoaded == 0 && phase == 0 {
-					goto __Exit
-				}
-				inputDataEnded = true
-				break
-			} else {
-				bytesToLoad -= uint(bytesLoaded)
-				totalLoaded += bytesLoaded
-			}
-		}
+	pWork.workBuffOffset = pWork.dsizeBytes + 0x204
+	pWork.bytesLoaded = 0
+	pWork.phase = 0
+	pWork.finder.reset(pWork.workBuffOffset)
+}
 
-		inputDataEndIndex = pWork.dsizeBytes + uint(totalLoaded)
-		if inputDataEnded {
-			inputDataEndIndex = inputDataEndIndex + uint(0x204)
-		}
-		//
-		// Warning: The end of the buffer passed to "sortBuffer" is actually 2 bytes beyond
-		// valid data. It is questionable if this is actually a bug or not,
-		// but it might cause the compressed data output to be dependent on random bytes
-		// that are in the buffer.
-		// To prevent that, the calling application must always zero the compression
-		// buffer before passing it to "implode"
-		//
-
-		// Search the PAIR_HASHes of the loaded blocks. Also, include
-		// previously compressed data, if any.
-		switch phase {
-		case 0:
-			sortBuffer(pWork, workBuffOffset, inputDataEndIndex+1)
-			phase++
-			if pWork.dsizeBytes != 0x1000 {
-				phase++
-			}
-		case 1:
-			sortBuffer(pWork, workBuffOffset-pWork.dsizeBytes+0x204, inputDataEndIndex+1)
-			phase++
+// Returns the part of the work buffer that the next input bytes are loaded into.
+func loadBuf(pWork *tCmpStruct) []uint8 {
+	return pWork.workBuff[pWork.dsizeBytes+0x204+pWork.bytesLoaded : pWork.dsizeBytes+0x204+0x1000]
+}
+
+// Compresses the block of pWork.bytesLoaded bytes that has been loaded
+// into the work buffer. Unless inputDataEnded is set, the block must be
+// full (0x1000 bytes), and the last 0x204 bytes of it are left for the
+// next block, so that repetitions can be searched beyond the block end.
+func writeCmpData(pWork *tCmpStruct, inputDataEnded bool) error {
+	var inputDataEndIndex uint // Pointer to the end of the input data
+	var workBuffOffset = pWork.workBuffOffset
+	var saveRepLength uint // Saved length of current repetition
+	var saveDistance uint  // Saved distance of current repetition
+	var repLength uint     // Length of the found repetition
+	var err error
+
+	// Stop if the context is done, once per block
+	if pWork.ctx != nil {
+		select {
+		case <-pWork.ctx.Done():
+			return pWork.ctx.Err()
 		default:
-			sortBuffer(pWork, workBuffOffset-pWork.dsizeBytes, inputDataEndIndex+1)
 		}
+	}
 
-		// Perform the compression of the current block
-		for workBuffOffset < inputDataEndIndex {
-			// Find if the current byte sequence wasn't there before.
-			repLength = findRep(pWork, workBuffOffset)
-			for repLength != 0 {
-				// If we found repetition of 2 bytes, that is 0x100 or fuhrter back,
-				// don't bother. Storing the distance of 0x100 bytes would actually
-				// take more space than storing the 2 bytes as-is.
-				if repLength == 2 && pWork.distance >= 0x100 {
-					break
-				}
-				// When we are at the end of the input data, we cannot allow
-				// the repetition to go past the end of the input data.
-				if inputDataEnded && workBuffOffset+repLength > inputDataEndIndex {
-					// Shorten the repetition length so that it only covers valid data
-					repLength = uint(inputDataEndIndex - workBuffOffset)
-					if repLength < 2 {
-						break
-					}
-					// If we got repetition of 2 bytes, that is 0x100 or more backward, don't bother
-					if repLength == 2 && pWork.distance >= 0x100 {
-						break
-					}
-					goto __FlushRepetition
-				}
-
-				if repLength >= 8 || workBuffOffset+1 >= inputDataEndIndex {
-					goto __FlushRepetition
-				}
-				// Try to find better repetition 1 byte later.
-				// Example: "ARROCKFORT" "AROCKFORT"
-				// When "input_data" points to the second string, findRep
-				// returns the occurrence of "AR". But there is longer repetition "ROCKFORT",
-				// beginning 1 byte after.
-				saveRepLength = repLength
-				saveDistance = pWork.distance
-				repLength = findRep(pWork, workBuffOffset+1)
-
-				// Only use the new repetition if it's length is greater than the previous one
-				if repLength > saveRepLength {
-					// If the new repetition if only 1 byte better
-					// and the previous distance is less than 0x80 bytes, use the previous repetition
-					if repLength > saveRepLength+1 || saveDistance > 0x80 {
-						// Flush one byte, so that input_data will point to the secondary repetition
-						err := outputBits(pWork, uint16(pWork.nChBits[pWork.workBuff[workBuffOffset]]), uint(pWork.nChCodes[pWork.workBuff[workBuffOffset]]))
-						if err != nil {
-							return err
-						}
-						workBuffOffset++
-						continue
-					}
-				}
+	if pWork.cType == ModeAuto {
+		chooseCompressionType(pWork)
+	}
 
-				// Revert to the previous repetition
-				repLength = saveRepLength
-				pWork.distance = saveDistance
+	inputDataEndIndex = pWork.dsizeBytes + pWork.bytesLoaded
+	if inputDataEnded {
+		inputDataEndIndex = inputDataEndIndex + uint(0x204)
+	}
+	dataEndIndex := pWork.dsizeBytes + 0x204 + pWork.bytesLoaded
+	if pWork.phase < 2 {
+		pWork.phase++
+	}
 
-			__FlushRepetition:
+	// Compress the block using the search of the compression level
+	switch {
+	case pWork.parse != nil:
+		workBuffOffset, err = compressOptimal(pWork, workBuffOffset, inputDataEndIndex, dataEndIndex)
+	case pWork.level != DefaultCompression:
+		workBuffOffset, err = compressChains(pWork, workBuffOffset, inputDataEndIndex, dataEndIndex)
+	}
+	if err != nil {
+		return err
+	}
 
-				err := outputBits(pWork, uint16(pWork.nChBits[repLength+0xFE]), uint(pWork.nChCodes[repLength+0xFE]))
-				if err != nil {
-					return err
+	// Perform the compression of the current block,
+	// unless it has already been done by the compression level
+	for workBuffOffset < inputDataEndIndex {
+		// Find if the current byte sequence wasn't there before.
+		repLength = findRep(pWork, workBuffOffset, dataEndIndex)
+		for repLength != 0 {
+			// If we found repetition of 2 bytes, that is 0x100 or fuhrter back,
+			// don't bother. Storing the distance of 0x100 bytes would actually
+			// take more space than storing the 2 bytes as-is.
+			if repLength == 2 && pWork.distance >= 0x100 {
+				break
+			}
+			// When we are at the end of the input data, we cannot allow
+			// the repetition to go past the end of the input data.
+			if inputDataEnded && workBuffOffset+repLength > inputDataEndIndex {
+				// Shorten the repetition length so that it only covers valid data
+				repLength = uint(inputDataEndIndex - workBuffOffset)
+				if repLength < 2 {
+					break
 				}
-				if repLength == 2 {
-					err = outputBits(pWork, uint16(pWork.distBits[pWork.distance>>2]), uint(pWork.distCodes[pWork.distance>>2]))
-					if err != nil {
-						return err
-					}
-					err = outputBits(pWork, 2, pWork.distance&3)
-					if err != nil {
-						return err
-					}
-				} else {
-					err = outputBits(pWork, uint16(pWork.distBits[pWork.distance>>pWork.dsizeBits]),
-						uint(pWork.distCodes[pWork.distance>>pWork.dsizeBits]))
-					if err != nil {
-						return err
-					}
-					err = outputBits(pWork, uint16(pWork.dsizeBits), pWork.dsizeMask&pWork.distance)
+				// If we got repetition of 2 bytes, that is 0x100 or more backward, don't bother
+				if repLength == 2 && pWork.distance >= 0x100 {
+					break
+				}
+				goto __FlushRepetition
+			}
+
+			if repLength >= 8 || workBuffOffset+1 >= inputDataEndIndex {
+				goto __FlushRepetition
+			}
+			// Try to find better repetition 1 byte later.
+			// Example: "ARROCKFORT" "AROCKFORT"
+			// When "input_data" points to the second string, findRep
+			// returns the occurrence of "AR". But there is longer repetition "ROCKFORT",
+			// beginning 1 byte after.
+			saveRepLength = repLength
+			saveDistance = pWork.distance
+			repLength = findRep(pWork, workBuffOffset+1, dataEndIndex)
+
+			// Only use the new repetition if it's length is greater than the previous one
+			if repLength > saveRepLength {
+				// If the new repetition if only 1 byte better
+				// and the previous distance is less than 0x80 bytes, use the previous repetition
+				if repLength > saveRepLength+1 || saveDistance > 0x80 {
+					// Flush one byte, so that input_data will point to the secondary repetition
+					err := outputLiteral(pWork, pWork.workBuff[workBuffOffset])
 					if err != nil {
 						return err
 					}
+					workBuffOffset++
+					continue
 				}
-
-				// Move the begin of the input data by the length of the repetition
-				workBuffOffset += repLength
-				goto _00402252
 			}
 
-			// If there was no previous repetition for the current position in the input data,
-			// just output the 9-bit literal for the one character
-			err = outputBits(pWork, uint16(pWork.nChBits[pWork.workBuff[workBuffOffset]]), uint(pWork.nChCodes[pWork.workBuff[workBuffOffset]]))
+			// Revert to the previous repetition
+			repLength = saveRepLength
+			pWork.distance = saveDistance
+
+		__FlushRepetition:
+
+			err := outputRepetition(pWork, repLength)
 			if err != nil {
 				return err
 			}
-			workBuffOffset++
-		_00402252:
+
+			// Move the begin of the input data by the length of the repetition
+			workBuffOffset += repLength
+			goto _00402252
 		}
 
-		if !inputDataEnded {
-			workBuffOffset -= 0x1000
-			copy(pWork.workBuff[0:pWork.dsizeBytes+0x204], pWork.workBuff[0x1000:0x1000+pWork.dsizeBytes+0x204])
+		// If there was no previous repetition for the current position in the input data,
+		// just output the 9-bit literal for the one character
+		err = outputLiteral(pWork, pWork.workBuff[workBuffOffset])
+		if err != nil {
+			return err
 		}
+		workBuffOffset++
+	_00402252:
 	}
 
-__Exit:
+	if !inputDataEnded {
+		workBuffOffset -= 0x1000
+		copy(pWork.workBuff[0:pWork.dsizeBytes+0x204], pWork.workBuff[0x1000:0x1000+pWork.dsizeBytes+0x204])
+		pWork.finder.shift(0x1000)
+	}
+	pWork.workBuffOffset = workBuffOffset
+	pWork.bytesLoaded = 0
+	return nil
+}
+
+// Compresses the last, possibly empty, block of input data
+// and writes the termination literal and all remaining output.
+func finishCmpData(pWork *tCmpStruct) error {
+	if pWork.cType == ModeAuto {
+		chooseCompressionType(pWork)
+	}
+	if pWork.bytesLoaded != 0 || pWork.phase != 0 {
+		// Zero the rest of the block, so that nothing of the previous
+		// stream is left past the end of the data
+		tail := loadBuf(pWork)
+		for m := range tail {
+			tail[m] = 0
+		}
+		err := writeCmpData(pWork, true)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Write the termination literal
-	err = outputBits(pWork, uint16(pWork.nChBits[0x305]), uint(pWork.nChCodes[0x305]))
+	err := outputBits(pWork, uint16(pWork.nChBits[0x305]), uint(pWork.nChCodes[0x305]))
 	if err != nil {
 		return err
 	}
@@ -735,23 +527,38 @@ __Exit:
 	return nil
 }
 
+// Compression levels for NewWriterLevel and WriterLevel. The levels from
+// BestSpeed to BestCompression search for repetitions using hash chains,
+// checking more candidates as the level increases. The lower levels are
+// greedy and store the repetition found at each position, the higher ones
+// first look for a longer repetition at the next position.
+// DefaultCompression searches the whole dictionary, and looks ahead for a
+// longer repetition the way the PKWARE implementation does.
+// MaxCompression finds the literals and repetitions that take the fewest
+// bits in each block. It is several times slower than BestCompression,
+// and meant for data that is compressed once and decompressed often.
+const (
+	BestSpeed          = 1
+	BestCompression    = 9
+	DefaultCompression = -1
+	MaxCompression     = -2
+)
+
 var (
 	// ErrInvalidDictSize is returned when writing data and an invalid dictionary size is specified.
 	ErrInvalidDictSize = errors.New("blast: invalid dictionary size")
 	// ErrInvalidMode is returned when writing data and an invalid implode mode was given.
 	ErrInvalidMode = errors.New("blast: invalid implode mode")
+	// ErrInvalidLevel is returned when an invalid compression level is given.
+	ErrInvalidLevel = errors.New("blast: invalid compression level")
 )
 
-func implode(r io.Reader, w io.Writer, workBuf *tCmpStruct, implodeType uint, dSize uint) error {
+// Fills the work structure for compressing data with the given
+// compression type and dictionary size, and starts a new stream.
+func implode(w io.Writer, workBuf *tCmpStruct, implodeType uint, dSize uint) error {
 	var pWork = workBuf
-	var nChCode uint
-	var nCount uint
-	var i uint
-	var nCount2 int
-	var err error
 	// Fill the work buffer information
 	// Note: The caller must zero the "workBuf" before passing it to implode
-	pWork.readBuf = r
 	pWork.writeBuf = w
 	pWork.dsizeBytes = dSize
 	pWork.cType = implodeType
@@ -778,77 +585,476 @@ func implode(r io.Reader, w io.Writer, workBuf *tCmpStruct, implodeType uint, dS
 	}
 
 	// Test the compression type
+	switch implodeType {
+	case Binary, ASCII:
+		setCompressionType(pWork, implodeType)
+	case ModeAuto:
+		// Chosen when the first block is compressed
+	default:
+		return ErrInvalidMode
+	}
+
+	startCmpData(pWork)
+	return nil
+}
+
+// Literal and length code tables of each compression type,
+// built once and only read after that
+var codeTables [ASCII + 1]struct {
+	nChBits  [0x306]uint8
+	nChCodes [0x306]uint16
+}
+
+func init() {
+	buildCodeTables(Binary)
+	buildCodeTables(ASCII)
+}
+
+// Fills the code tables of the given compression type.
+func buildCodeTables(implodeType uint) {
+	var nChCode uint
+	var nCount uint
+	var i uint
+	var nCount2 int
+	t := &codeTables[implodeType]
+
 	switch implodeType {
 	case Binary: // We will compress data with binary compression type
-		nChCode = 0
 		for nCount = 0; nCount < 0x100; nCount++ {
-			pWork.nChBits[nCount] = 9
-			pWork.nChCodes[nCount] = uint16(nChCode)
+			t.nChBits[nCount] = 9
+			t.nChCodes[nCount] = uint16(nChCode)
 			nChCode = (nChCode & 0x0000FFFF) + 2
 		}
 	case ASCII: // We will compress data with ASCII compression type
 		for nCount = 0; nCount < 0x100; nCount++ {
-			pWork.nChBits[nCount] = uint8(chBitsAscs[nCount] + 1)
-			pWork.nChCodes[nCount] = uint16(chCodeAscs[nCount] * 2)
+			t.nChBits[nCount] = uint8(chBitsAscs[nCount] + 1)
+			t.nChCodes[nCount] = uint16(chCodeAscs[nCount] * 2)
 		}
-	default:
-		return ErrInvalidMode
 	}
 
+	nCount = 0x100
 	for i = 0; i < 0x10; i++ {
 		if 1<<exLenBits[i] != 0 {
 			for nCount2 = 0; nCount2 < (1 << exLenBits[i]); nCount2++ {
-				pWork.nChBits[nCount] = uint8(exLenBits[i] + lenBits[i] + 1)
-				pWork.nChCodes[nCount] = uint16((uint16(nCount2) << uint16(lenBits[i]+1)) | uint16((uint16(lenCodes[i])&0x00FF)*2) | 1)
+				t.nChBits[nCount] = uint8(exLenBits[i] + lenBits[i] + 1)
+				t.nChCodes[nCount] = uint16((uint16(nCount2) << uint16(lenBits[i]+1)) | uint16((uint16(lenCodes[i])&0x00FF)*2) | 1)
 				nCount++
 			}
 		}
 	}
+}
 
-	// Copy the distance codes and distance bits and perform the compression
-	copy(pWork.distCodes, distCodes)
-	copy(pWork.distBits, distBits)
-	err = writeCmpData(pWork)
-	if err != nil {
-		return err
+// Selects the code tables of the work structure for the given
+// compression type, and stores the type in the output buffer.
+func setCompressionType(pWork *tCmpStruct, implodeType uint) {
+	pWork.cType = implodeType
+	pWork.outBuff[0] = uint8(implodeType)
+	pWork.nChBits = &codeTables[implodeType].nChBits
+	pWork.nChCodes = &codeTables[implodeType].nChCodes
+}
+
+// Chooses the compression type for ModeAuto, the one in which the bytes
+// loaded into the first block take fewer bits as literals.
+func chooseCompressionType(pWork *tCmpStruct) {
+	var asciiBits uint
+	for _, ch := range pWork.workBuff[pWork.dsizeBytes+0x204 : pWork.dsizeBytes+0x204+pWork.bytesLoaded] {
+		asciiBits += uint(chBitsAscs[ch]) + 1
+	}
+	if asciiBits < 9*pWork.bytesLoaded {
+		setCompressionType(pWork, ASCII)
+	} else {
+		setCompressionType(pWork, Binary)
 	}
-	return nil
 }
 
 // A Writer takes data written to it and writes the compressed
 // form of that data to an underlying writer (see NewWriter).
 type Writer struct {
-	w           io.Writer
 	compressor  *tCmpStruct
 	implodeType uint
 	dictSize    uint
-	data        []uint8
+	err         error // first error, returned by all later calls
+
+	// For DictionarySizeAuto, the first block is kept in sample until
+	// the dictionary size is chosen
+	dst      io.Writer
+	sample   []byte
+	sampling bool
+	trial    byteCounter // Size of a trial compression of sample
+
+	dict []byte // Preset dictionary, see NewWriterDict
+	crc  uint32 // CRC of the data written since the last Reset
+}
+
+// Starts a new stream written to dst, with the preset dictionary if any.
+func (w *Writer) start(dst io.Writer, dictSize uint) error {
+	if err := implode(dst, w.compressor, w.implodeType, dictSize); err != nil {
+		return err
+	}
+	loadDictionary(w.compressor, w.dict)
+	return nil
+}
+
+// A byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// An appendBuffer appends the bytes written to it.
+type appendBuffer []byte
+
+func (b *appendBuffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
 }
 
+// Chooses the dictionary size for DictionarySizeAuto, the one with which
+// sample compresses to the fewest bytes, and loads sample into the
+// compressor to be compressed with it.
+func (w *Writer) chooseDictSize() error {
+	c := w.compressor
+	w.sampling = false
+	best, bestSize := uint(0), byteCounter(0)
+	for _, dictSize := range [...]uint{DictionarySize1024, DictionarySize2048, DictionarySize4096} {
+		w.trial = 0
+		if err := w.start(&w.trial, dictSize); err != nil {
+			return err
+		}
+		c.bytesLoaded = uint(copy(loadBuf(c), w.sample))
+		if err := finishCmpData(c); err != nil {
+			return err
+		}
+		if best == 0 || w.trial < bestSize {
+			best, bestSize = dictSize, w.trial
+		}
+	}
+	if err := w.start(w.dst, best); err != nil {
+		return err
+	}
+	c.bytesLoaded = uint(copy(loadBuf(c), w.sample))
+	if c.bytesLoaded == 0x1000 {
+		return writeCmpData(c, false)
+	}
+	return nil
+}
+
+var errWriterClosed = errors.New("blast: write to closed writer")
+
 // NewWriter creates a new Writer.
 // Writes to the returned Writer are compressed and written to w.
 //
 // It is the caller's responsibility to call Close on the WriteCloser when done.
-// Writes may be buffered and not flushed until Close.
+// Writes are compressed in blocks of 4K, so up to 4K of data may be
+// buffered and not flushed until Close.
+// With ModeAuto as implodeType or DictionarySizeAuto as dictSize, the
+// mode or dictionary size is chosen from the first 4K block, before
+// anything is written to w. Header reports the choice.
+// An invalid implodeType or dictSize is returned by Write and Close,
+// use NewWriterOptions to have it reported up front.
 func NewWriter(w io.Writer, implodeType uint, dictSize uint) *Writer {
+	return newWriter(w, implodeType, dictSize, DefaultCompression)
+}
+
+// NewWriterDict is like NewWriter but compresses with a preset dictionary.
+// Repetitions can be found in the end of dict, up to the dictionary size,
+// as if dict had been written before the data. The stream can only be
+// decompressed by NewReaderDict with the same dict. dict is copied, and
+// kept when the Writer is Reset.
+func NewWriterDict(w io.Writer, implodeType uint, dictSize uint, dict []byte) *Writer {
+	writer := newWriter(w, implodeType, dictSize, DefaultCompression)
+	if len(dict) > DictionarySize4096 {
+		dict = dict[len(dict)-DictionarySize4096:]
+	}
+	writer.dict = append([]byte(nil), dict...)
+	writer.Reset(w)
+	return writer
+}
+
+// NewWriterLevel is like NewWriter but specifies the compression level
+// instead of assuming DefaultCompression. The compression level can be
+// DefaultCompression, MaxCompression, or any integer value between
+// BestSpeed and BestCompression inclusive. The error returned will be nil
+// if the level is valid, the mode and dictionary size are checked by Write
+// and Close as with NewWriter.
+func NewWriterLevel(w io.Writer, implodeType uint, dictSize uint, level int) (*Writer, error) {
+	if !validLevel(level) {
+		return nil, ErrInvalidLevel
+	}
+	return newWriter(w, implodeType, dictSize, level), nil
+}
+
+func validLevel(level int) bool {
+	return level == DefaultCompression || level == MaxCompression || (level >= BestSpeed && level <= BestCompression)
+}
+
+func newWriter(w io.Writer, implodeType uint, dictSize uint, level int) *Writer {
 	compressor := newTCmpStruct()
+	compressor.level = level
+	switch level {
+	case DefaultCompression:
+		compressor.finder = newHashChain(exhaustive)
+	case MaxCompression:
+		compressor.finder = newHashChain(exhaustive)
+		compressor.parse = new(optimalParse)
+	default:
+		compressor.finder = newHashChain(levels[level])
+	}
 	writer := new(Writer)
-	writer.w = w
+	writer.compressor = compressor
 	writer.implodeType = implodeType
 	writer.dictSize = dictSize
-	writer.compressor = compressor
-	writer.data = make([]byte, 0)
+	writer.Reset(w)
 	return writer
 }
 
+// A WriterOption sets an option of a Writer created by NewWriterOptions.
+type WriterOption func(*writerOptions) error
+
+// writer options, set to their defaults by NewWriterOptions
+type writerOptions struct {
+	mode     Mode
+	dictSize DictionarySize
+	level    int
+}
+
+// WriterMode sets the compression mode, Binary, ASCII or ModeAuto.
+// The default is Binary.
+func WriterMode(mode Mode) WriterOption {
+	return func(o *writerOptions) error {
+		if mode != Binary && mode != ASCII && mode != ModeAuto {
+			return ErrInvalidMode
+		}
+		o.mode = mode
+		return nil
+	}
+}
+
+// WriterDictionarySize sets the dictionary size, DictionarySize1024,
+// DictionarySize2048, DictionarySize4096 or DictionarySizeAuto.
+// The default is DictionarySize4096.
+func WriterDictionarySize(size DictionarySize) WriterOption {
+	return func(o *writerOptions) error {
+		if size != DictionarySize1024 && size != DictionarySize2048 && size != DictionarySize4096 && size != DictionarySizeAuto {
+			return ErrInvalidDictSize
+		}
+		o.dictSize = size
+		return nil
+	}
+}
+
+// WriterLevel sets the compression level, see NewWriterLevel.
+// The default is DefaultCompression.
+func WriterLevel(level int) WriterOption {
+	return func(o *writerOptions) error {
+		if !validLevel(level) {
+			return ErrInvalidLevel
+		}
+		o.level = level
+		return nil
+	}
+}
+
+// NewWriterOptions creates a new Writer like NewWriter, with the compression
+// mode, dictionary size and level set by options. Invalid options are
+// reported here, before any data is written.
+func NewWriterOptions(w io.Writer, opts ...WriterOption) (*Writer, error) {
+	o := writerOptions{mode: Binary, dictSize: DictionarySize4096, level: DefaultCompression}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	writer := newWriter(w, uint(o.mode), uint(o.dictSize), o.level)
+	if writer.err != nil {
+		return nil, writer.err
+	}
+	return writer, nil
+}
+
+// NewWriterContext is like NewWriter but compression stops when ctx is
+// done. ctx is checked before each 4K block of input is compressed, and
+// Write and Close return ctx.Err() once it is done. ctx is kept when the
+// Writer is Reset.
+func NewWriterContext(ctx context.Context, w io.Writer, implodeType uint, dictSize uint) *Writer {
+	writer := NewWriter(w, implodeType, dictSize)
+	writer.compressor.ctx = ctx
+	return writer
+}
+
+// A Writer for Compress, with the buffer it writes to
+type bufferWriter struct {
+	w   *Writer
+	out appendBuffer
+}
+
+var bufferWriters = sync.Pool{New: func() interface{} {
+	return &bufferWriter{w: newWriter(nil, Binary, DictionarySize4096, DefaultCompression)}
+}}
+
+// Compress appends the compressed form of src to dst, as a single stream
+// compressed at DefaultCompression with the given mode and dictionary size,
+// which can be ModeAuto and DictionarySizeAuto, and returns the result.
+// The work buffers are reused by later calls, so no memory is allocated
+// once dst has enough spare capacity for the compressed data.
+func Compress(dst, src []byte, mode, dictSize uint) ([]byte, error) {
+	b := bufferWriters.Get().(*bufferWriter)
+	defer bufferWriters.Put(b)
+	b.w.implodeType, b.w.dictSize = mode, dictSize
+	b.out = dst
+	b.w.Reset(&b.out)
+	_, err := b.w.Write(src)
+	if err == nil {
+		err = b.w.Close()
+	}
+	out := b.out
+	b.out = nil
+	if err != nil {
+		return dst, err
+	}
+	return out, nil
+}
+
+// Reset discards the writer's state and makes it equivalent to the
+// result of NewWriter with the same compression type and dictionary size,
+// but writing to dst instead. The work buffers of the writer are reused,
+// so no memory is allocated.
+func (w *Writer) Reset(dst io.Writer) {
+	w.crc = 0
+	if w.dictSize == DictionarySizeAuto {
+		if w.sample == nil {
+			w.sample = make([]byte, 0, 0x1000)
+		}
+		w.dst = dst
+		w.sample = w.sample[:0]
+		w.sampling = true
+		// Check the mode, the dictionary size is set when it is chosen
+		w.err = implode(dst, w.compressor, w.implodeType, DictionarySize4096)
+		return
+	}
+	w.err = w.start(dst, w.dictSize)
+}
+
+// Header returns the header of the stream being written. The mode and
+// dictionary size chosen for ModeAuto and DictionarySizeAuto are known
+// once the first 4K block has been compressed, and always after Close.
+// Until then, they are returned as ModeAuto and DictionarySizeAuto.
+func (w *Writer) Header() Header {
+	h := Header{Mode: Mode(w.compressor.cType), DictionarySize: DictionarySize(w.compressor.dsizeBytes)}
+	if w.sampling {
+		h.DictionarySize = DictionarySizeAuto
+	}
+	return h
+}
+
+// Crc32 returns the CRC-32 checksum of the uncompressed data written to
+// the Writer since it was created or Reset, in the IEEE convention of
+// NewCrc32. Containers such as ZIP store it next to the compressed data.
+// Its complement is the Crc32 of the data from 0xFFFFFFFF.
+func (w *Writer) Crc32() uint32 {
+	return w.crc
+}
+
+// Returns the buffer the next input bytes are loaded into.
+func (w *Writer) buffer() []byte {
+	if w.sampling {
+		return w.sample[len(w.sample):cap(w.sample)]
+	}
+	return loadBuf(w.compressor)
+}
+
+// Takes n bytes loaded into the buffer, and compresses a block when it
+// is full.
+func (w *Writer) loaded(n int) error {
+	w.crc = crc32.Update(w.crc, crc32.IEEETable, w.buffer()[:n])
+	if w.sampling {
+		w.sample = w.sample[:len(w.sample)+n]
+		if len(w.sample) == cap(w.sample) {
+			return w.chooseDictSize()
+		}
+		return nil
+	}
+	w.compressor.bytesLoaded += uint(n)
+	if w.compressor.bytesLoaded == 0x1000 {
+		return writeCmpData(w.compressor, false)
+	}
+	return nil
+}
+
 // Write writes a compressed form of p to the underlying io.Writer. The
 // compressed bytes are not necessarily flushed until the Writer is closed.
 func (w *Writer) Write(p []byte) (int, error) {
-	w.data = append(w.data, p...)
-	return len(p), nil
+	var n int
+	if w.err != nil {
+		return 0, w.err
+	}
+	for len(p) > 0 {
+		loaded := copy(w.buffer(), p)
+		n += loaded
+		p = p[loaded:]
+		if w.err = w.loaded(loaded); w.err != nil {
+			return n, w.err
+		}
+	}
+	return n, nil
+}
+
+// The number of reads without data after which ReadFrom gives up.
+const maxEmptyReads = 100
+
+// ReadFrom implements io.ReaderFrom. It compresses the data read from r
+// until io.EOF, loading it directly into the work buffer. Any other error
+// returned by r is returned, and by all later calls of Write and Close
+// too, so that a stream is never completed with part of its data missing.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	if w.err != nil {
+		return 0, w.err
+	}
+	for empty := 0; ; {
+		loaded, err := r.Read(w.buffer())
+		n += int64(loaded)
+		if loaded > 0 {
+			empty = 0
+			if w.err = w.loaded(loaded); w.err != nil {
+				return n, w.err
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return n, nil
+		case err != nil:
+			w.err = err
+			return n, err
+		case loaded == 0:
+			if empty++; empty == maxEmptyReads {
+				w.err = io.ErrNoProgress
+				return n, w.err
+			}
+		}
+	}
 }
 
 // Close flushes and closes the writer.
 func (w *Writer) Close() error {
-	return implode(bytes.NewBuffer(w.data), w.w, w.compressor, w.implodeType, w.dictSize)
+	if w.err == errWriterClosed {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.sampling {
+		w.err = w.chooseDictSize()
+		if w.err != nil {
+			return w.err
+		}
+	}
+	w.err = finishCmpData(w.compressor)
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errWriterClosed
+	return nil
 }
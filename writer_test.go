@@ -2,9 +2,16 @@ package blast_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/JoshVarga/blast"
@@ -64,3 +71,735 @@ func randomBytes(length, unique int) []uint8 {
 	}
 	return b
 }
+
+func TestStreamingWrite(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(random.Intn(20))
+	}
+	var oneShot bytes.Buffer
+	w := blast.NewWriter(&oneShot, blast.ASCII, blast.DictionarySize4096)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("error writing %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error closing %v", err)
+	}
+
+	var streamed bytes.Buffer
+	w = blast.NewWriter(&streamed, blast.ASCII, blast.DictionarySize4096)
+	for p := data; len(p) > 0; {
+		n := random.Intn(10000)
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("error writing %v", err)
+		}
+		p = p[n:]
+	}
+	if streamed.Len() == 0 {
+		t.Error("no compressed data written before Close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error closing %v", err)
+	}
+	if !bytes.Equal(streamed.Bytes(), oneShot.Bytes()) {
+		t.Error("streamed output differs from one-shot output")
+	}
+}
+
+type emptyReader struct{}
+
+func (emptyReader) Read([]byte) (int, error) { return 0, nil }
+
+func TestWriterReadFrom(t *testing.T) {
+	data := benchmarkText(20000)
+	for _, dictSize := range []uint{blast.DictionarySize4096, blast.DictionarySizeAuto} {
+		var expected bytes.Buffer
+		w := blast.NewWriter(&expected, blast.ModeAuto, dictSize)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("error writing %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+
+		var b bytes.Buffer
+		w.Reset(&b)
+		n, err := io.Copy(w, iotest.OneByteReader(bytes.NewReader(data)))
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("dictSize=%v: found=%v, %v : expected=%v, nil", dictSize, n, err, len(data))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+		if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+			t.Errorf("dictSize=%v: output differs from Write", dictSize)
+		}
+	}
+
+	errRead := errors.New("read failed")
+	for _, test := range []struct {
+		r   io.Reader
+		err error
+	}{
+		{iotest.ErrReader(errRead), errRead},
+		{io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errRead)), errRead},
+		{iotest.TimeoutReader(bytes.NewReader(data)), iotest.ErrTimeout},
+		{io.MultiReader(bytes.NewReader(data), emptyReader{}), io.ErrNoProgress},
+	} {
+		var b bytes.Buffer
+		w := blast.NewWriter(&b, blast.ModeAuto, blast.DictionarySizeAuto)
+		if _, err := w.ReadFrom(test.r); err != test.err {
+			t.Errorf("found=%v : expected=%v", err, test.err)
+		}
+		if _, err := w.Write(data); err != test.err {
+			t.Errorf("found=%v from Write : expected=%v", err, test.err)
+		}
+		if err := w.Close(); err != test.err {
+			t.Errorf("found=%v from Close : expected=%v", err, test.err)
+		}
+	}
+}
+
+func TestCompressBlockBoundaries(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, length := range []int{0, 1, 4095, 4096, 4097, 8191, 8192, 20000} {
+		for _, dictSize := range []uint{blast.DictionarySize1024, blast.DictionarySize2048, blast.DictionarySize4096} {
+			data := make([]byte, length)
+			for i := range data {
+				data[i] = byte(random.Intn(256))
+			}
+			var b bytes.Buffer
+			w := blast.NewWriter(&b, blast.Binary, dictSize)
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("error closing %v", err)
+			}
+			blastReader, err := blast.NewReader(&b)
+			if err != nil {
+				t.Fatalf("error reading %v", err)
+			}
+			decoded, err := ioutil.ReadAll(blastReader)
+			if err != nil {
+				t.Fatalf("error decoding %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("length=%v dictSize=%v: decoded data does not match", length, dictSize)
+			}
+		}
+	}
+}
+
+func TestInvalidDictSize(t *testing.T) {
+	var b bytes.Buffer
+	w := blast.NewWriter(&b, blast.Binary, 4)
+	if _, err := w.Write([]byte("AIAIAIAIAIAIA")); err != blast.ErrInvalidDictSize {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidDictSize)
+	}
+	if err := w.Close(); err != blast.ErrInvalidDictSize {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidDictSize)
+	}
+}
+
+func TestWriterOptions(t *testing.T) {
+	data := []byte("AIAIAIAIAIAIA")
+	var expected bytes.Buffer
+	w := blast.NewWriter(&expected, blast.ASCII, blast.DictionarySize2048)
+	_, _ = w.Write(data)
+	_ = w.Close()
+
+	var b bytes.Buffer
+	w, err := blast.NewWriterOptions(&b, blast.WriterMode(blast.ASCII), blast.WriterDictionarySize(blast.DictionarySize2048))
+	if err != nil {
+		t.Fatalf("error creating writer %v", err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("error writing %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("error closing %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+		t.Errorf("found=%v : expected=%v", b.Bytes(), expected.Bytes())
+	}
+
+	if _, err = blast.NewWriterOptions(&b, blast.WriterDictionarySize(4)); err != blast.ErrInvalidDictSize {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidDictSize)
+	}
+	if _, err = blast.NewWriterOptions(&b, blast.WriterMode(3)); err != blast.ErrInvalidMode {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidMode)
+	}
+}
+
+func TestModeString(t *testing.T) {
+	for _, test := range []struct {
+		value    fmt.Stringer
+		expected string
+	}{
+		{blast.Mode(blast.Binary), "binary"},
+		{blast.Mode(blast.ASCII), "ascii"},
+		{blast.Mode(blast.ModeAuto), "auto"},
+		{blast.Mode(3), "Mode(3)"},
+		{blast.DictionarySize(blast.DictionarySize2048), "2048"},
+		{blast.DictionarySize(blast.DictionarySizeAuto), "auto"},
+		{blast.DictionarySize(4), "DictionarySize(4)"},
+	} {
+		if found := test.value.String(); found != test.expected {
+			t.Errorf("found=%v : expected=%v", found, test.expected)
+		}
+	}
+}
+
+func TestModeAuto(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	binary := make([]byte, 10000)
+	random.Read(binary)
+	auto := blast.NewWriter(nil, blast.ModeAuto, blast.DictionarySize2048)
+	for _, test := range []struct {
+		data []byte
+		mode uint
+	}{
+		{nil, blast.Binary},
+		{benchmarkText(10000), blast.ASCII},
+		{binary, blast.Binary},
+		{append(benchmarkText(4096), binary...), blast.ASCII},
+		{append(binary[:4096], benchmarkText(10000)...), blast.Binary},
+	} {
+		var expected bytes.Buffer
+		w := blast.NewWriter(&expected, test.mode, blast.DictionarySize2048)
+		if _, err := w.Write(test.data); err != nil {
+			t.Fatalf("error writing %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+
+		// Write in small pieces, so that the mode is chosen from the first block,
+		// and choose it again after Reset
+		var b bytes.Buffer
+		auto.Reset(&b)
+		for p := test.data; len(p) > 0; {
+			n := random.Intn(1000)
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := auto.Write(p[:n]); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			p = p[n:]
+		}
+		if err := auto.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+		if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+			t.Errorf("length=%v: output differs from mode %v", len(test.data), blast.Mode(test.mode))
+		}
+	}
+}
+
+func TestDictionarySizeAuto(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	auto := blast.NewWriter(nil, blast.ModeAuto, blast.DictionarySizeAuto)
+	for _, length := range []int{0, 100, 1000, 4095, 4096, 4097, 20000} {
+		data := benchmarkText(length)
+		sample := data
+		if len(sample) > 4096 {
+			sample = sample[:4096]
+		}
+		var smallest []byte
+		for _, dictSize := range []uint{blast.DictionarySize1024, blast.DictionarySize2048, blast.DictionarySize4096} {
+			var b bytes.Buffer
+			w := blast.NewWriter(&b, blast.ModeAuto, dictSize)
+			if _, err := w.Write(sample); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("error closing %v", err)
+			}
+			if smallest == nil || b.Len() < len(smallest) {
+				smallest = b.Bytes()
+			}
+		}
+		expectedSize := blast.DictionarySize(64 << smallest[1])
+
+		var b bytes.Buffer
+		auto.Reset(&b)
+		if h := auto.Header(); h.DictionarySize != blast.DictionarySizeAuto {
+			t.Errorf("length=%v: found=%v before writing : expected=%v", length, h.DictionarySize, blast.DictionarySizeAuto)
+		}
+		for p := data; len(p) > 0; {
+			n := random.Intn(1000)
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := auto.Write(p[:n]); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			p = p[n:]
+		}
+		if err := auto.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+		if h := auto.Header(); h.DictionarySize != expectedSize || h.Mode != blast.ASCII && length > 0 {
+			t.Errorf("length=%v: found=%v : expected=%v", length, h, blast.Header{Mode: blast.ASCII, DictionarySize: expectedSize})
+		}
+
+		var expected bytes.Buffer
+		w := blast.NewWriter(&expected, blast.ModeAuto, uint(expectedSize))
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("error writing %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+		if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+			t.Errorf("length=%v: output differs from dictionary size %v", length, expectedSize)
+		}
+	}
+}
+
+func TestPresetDict(t *testing.T) {
+	record := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"user%d","email":"user%d@example.com","active":true,"roles":["reader","writer"]}`, i, i, i))
+	}
+	var dict []byte
+	for i := 0; i < 100; i++ {
+		dict = append(dict, record(1000+i)...)
+	}
+	// Records that share the dictionary's boilerplate, and data longer than the window
+	tests := [][]byte{nil, record(1), record(2), benchmarkText(20000)}
+	var r *blast.Reader
+	for _, dictSize := range []uint{blast.DictionarySize1024, blast.DictionarySize2048, blast.DictionarySize4096, blast.DictionarySizeAuto} {
+		for _, data := range tests {
+			var plain, b bytes.Buffer
+			w := blast.NewWriter(&plain, blast.ModeAuto, dictSize)
+			_, _ = w.Write(data)
+			_ = w.Close()
+			w = blast.NewWriterDict(&b, blast.ModeAuto, dictSize, dict)
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("error closing %v", err)
+			}
+			if len(data) > 0 && len(data) < 1000 && b.Len()*2 > plain.Len() {
+				t.Errorf("dictSize=%v length=%v: found=%v bytes with dictionary : expected at most half of %v", dictSize, len(data), b.Len(), plain.Len())
+			}
+			compressed := b.Bytes()
+
+			var err error
+			if r == nil {
+				r, err = blast.NewReaderDict(bytes.NewReader(compressed), dict)
+			} else {
+				err = r.Reset(bytes.NewReader(compressed))
+			}
+			if err != nil {
+				t.Fatalf("error reading %v", err)
+			}
+			decoded, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("dictSize=%v length=%v: error decoding %v", dictSize, len(data), err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("dictSize=%v length=%v: decoded data does not match", dictSize, len(data))
+			}
+		}
+	}
+
+	// Without the dictionary, the distances into it are too far back
+	var b bytes.Buffer
+	w := blast.NewWriterDict(&b, blast.Binary, blast.DictionarySize4096, dict)
+	_, _ = w.Write(record(1))
+	_ = w.Close()
+	plain, err := blast.NewReader(&b)
+	if err != nil {
+		t.Fatalf("error reading %v", err)
+	}
+	if _, err = ioutil.ReadAll(plain); !errors.Is(err, blast.ErrDistanceTooFar) {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrDistanceTooFar)
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	first := randomBytes(20000, 256)
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(random.Intn(8))
+	}
+	var expected bytes.Buffer
+	w := blast.NewWriter(&expected, blast.Binary, blast.DictionarySize2048)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("error writing %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error closing %v", err)
+	}
+
+	var b bytes.Buffer
+	w = blast.NewWriter(&b, blast.Binary, blast.DictionarySize2048)
+	if _, err := w.Write(first); err != nil {
+		t.Fatalf("error writing %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error closing %v", err)
+	}
+	b.Grow(2 * expected.Len())
+	allocs := testing.AllocsPerRun(10, func() {
+		b.Reset()
+		w.Reset(&b)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("error writing %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("found=%v allocations : expected=0", allocs)
+	}
+	if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+		t.Error("output after Reset differs from a new writer")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := benchmarkText(20000)
+	for _, mode := range []uint{blast.Binary, blast.ASCII, blast.ModeAuto} {
+		for _, dictSize := range []uint{blast.DictionarySize1024, blast.DictionarySize4096, blast.DictionarySizeAuto} {
+			for _, length := range []int{0, 100, 20000} {
+				var expected bytes.Buffer
+				w := blast.NewWriter(&expected, mode, dictSize)
+				if _, err := w.Write(data[:length]); err != nil {
+					t.Fatalf("error writing %v", err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("error closing %v", err)
+				}
+				compressed, err := blast.Compress([]byte("prefix"), data[:length], mode, dictSize)
+				if err != nil {
+					t.Fatalf("error compressing %v", err)
+				}
+				if !bytes.Equal(compressed, append([]byte("prefix"), expected.Bytes()...)) {
+					t.Errorf("mode=%v dictSize=%v length=%v: output differs from NewWriter", mode, dictSize, length)
+				}
+			}
+		}
+	}
+
+	if _, err := blast.Compress(nil, data, blast.Binary, 3000); err != blast.ErrInvalidDictSize {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidDictSize)
+	}
+	if _, err := blast.Compress(nil, data, 5, blast.DictionarySize1024); err != blast.ErrInvalidMode {
+		t.Errorf("found=%v : expected=%v", err, blast.ErrInvalidMode)
+	}
+
+	// Nothing is allocated once dst is large enough
+	dst := make([]byte, 0, len(data))
+	var compressed []byte
+	allocs := testing.AllocsPerRun(10, func() {
+		var err error
+		if compressed, err = blast.Compress(dst, data, blast.ASCII, blast.DictionarySize4096); err != nil {
+			t.Fatalf("error compressing %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("found=%v allocations : expected=0", allocs)
+	}
+	decoded, err := blast.Decompress(nil, compressed)
+	if err != nil {
+		t.Fatalf("error decoding %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Error("decoded data does not match")
+	}
+}
+
+func TestWriterCrc32(t *testing.T) {
+	data := benchmarkText(20000)
+	for _, dictSize := range []uint{blast.DictionarySize2048, blast.DictionarySizeAuto} {
+		w := blast.NewWriter(ioutil.Discard, blast.ASCII, dictSize)
+		for i := 0; i < 2; i++ {
+			if crc := w.Crc32(); crc != 0 {
+				t.Errorf("dictSize=%v: found=%#x before writing : expected=0", dictSize, crc)
+			}
+			if _, err := w.Write(data[:5000]); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			if _, err := w.ReadFrom(iotest.OneByteReader(bytes.NewReader(data[5000:]))); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("error closing %v", err)
+			}
+			if crc := w.Crc32(); crc != crc32.ChecksumIEEE(data) {
+				t.Errorf("dictSize=%v: found=%#x : expected=%#x", dictSize, crc, crc32.ChecksumIEEE(data))
+			}
+			if crc := ^w.Crc32(); crc != blast.Crc32(data, 0xFFFFFFFF) {
+				t.Errorf("dictSize=%v: found=%#x : expected=%#x", dictSize, crc, blast.Crc32(data, 0xFFFFFFFF))
+			}
+			w.Reset(ioutil.Discard)
+		}
+	}
+}
+
+func TestWriterContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var b bytes.Buffer
+	w := blast.NewWriterContext(ctx, &b, blast.Binary, blast.DictionarySize1024)
+	data := randomBytes(0x3000, 256)
+	if _, err := w.Write(data[:0x1000]); err != nil {
+		t.Fatalf("error writing %v", err)
+	}
+	cancel()
+	if _, err := w.Write(data[0x1000:]); err != context.Canceled {
+		t.Errorf("found=%v : expected=%v", err, context.Canceled)
+	}
+	if err := w.Close(); err != context.Canceled {
+		t.Errorf("found=%v : expected=%v", err, context.Canceled)
+	}
+}
+
+func TestWriterLevels(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	text := benchmarkText(20000)
+	for _, length := range []int{0, 1, 2, 4095, 4096, 4097, 8192, 20000} {
+		data := make([]byte, length)
+		for i := range data {
+			data[i] = byte(random.Intn(8))
+		}
+		for _, src := range [][]byte{data, text[:length]} {
+			for _, mode := range []uint{blast.Binary, blast.ASCII} {
+				for _, dictSize := range []uint{blast.DictionarySize1024, blast.DictionarySize2048, blast.DictionarySize4096} {
+					for _, level := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, blast.MaxCompression} {
+						var b bytes.Buffer
+						w, err := blast.NewWriterLevel(&b, mode, dictSize, level)
+						if err != nil {
+							t.Fatalf("error creating writer %v", err)
+						}
+						if _, err = w.Write(src); err != nil {
+							t.Fatalf("error writing %v", err)
+						}
+						if err = w.Close(); err != nil {
+							t.Fatalf("error closing %v", err)
+						}
+						blastReader, err := blast.NewReader(&b)
+						if err != nil {
+							t.Fatalf("error reading %v", err)
+						}
+						decoded, err := ioutil.ReadAll(blastReader)
+						if err != nil {
+							t.Fatalf("length=%v mode=%v dictSize=%v level=%v: error decoding %v", length, mode, dictSize, level, err)
+						}
+						if !bytes.Equal(decoded, src) {
+							t.Errorf("length=%v mode=%v dictSize=%v level=%v: decoded data does not match", length, mode, dictSize, level)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestWriterLevelRatio(t *testing.T) {
+	data := benchmarkText(1 << 18)
+	size := func(level int) int {
+		var b bytes.Buffer
+		w, err := blast.NewWriterLevel(&b, blast.ASCII, blast.DictionarySize4096, level)
+		if err != nil {
+			t.Fatalf("error creating writer %v", err)
+		}
+		if _, err = w.Write(data); err != nil {
+			t.Fatalf("error writing %v", err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+		return b.Len()
+	}
+	if best, def := size(blast.BestCompression), size(blast.DefaultCompression); best > def {
+		t.Errorf("found=%v bytes at BestCompression : expected at most %v", best, def)
+	}
+	if max, best := size(blast.MaxCompression), size(blast.BestCompression); max > best {
+		t.Errorf("found=%v bytes at MaxCompression : expected at most %v", max, best)
+	}
+	if fast, best := size(blast.BestSpeed), size(blast.BestCompression); fast < best {
+		t.Errorf("found=%v bytes at BestSpeed : expected at least %v", fast, best)
+	}
+}
+
+func TestWriterLevelReset(t *testing.T) {
+	first := randomBytes(20000, 256)
+	data := benchmarkText(20000)
+	for _, level := range []int{blast.BestCompression, blast.MaxCompression} {
+		var expected bytes.Buffer
+		w, _ := blast.NewWriterLevel(&expected, blast.Binary, blast.DictionarySize2048, level)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("error writing %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("error closing %v", err)
+		}
+
+		var b bytes.Buffer
+		w, _ = blast.NewWriterLevel(&b, blast.Binary, blast.DictionarySize2048, level)
+		for i := 0; i < 3; i++ {
+			b.Reset()
+			w.Reset(&b)
+			if i == 0 {
+				_, _ = w.Write(first)
+				_ = w.Close()
+				continue
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("error writing %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("error closing %v", err)
+			}
+			if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+				t.Error("output after Reset differs from a new writer")
+			}
+		}
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestWriterDirtyBuffers(t *testing.T) {
+	text := benchmarkText(20000)
+	dirt := randomBytes(0x2a00, 256)
+	for _, mode := range []uint{blast.Binary, blast.ASCII, blast.ModeAuto} {
+		for _, dictSize := range []uint{blast.DictionarySize1024, blast.DictionarySize4096, blast.DictionarySizeAuto} {
+			for _, level := range []int{blast.BestSpeed, blast.BestCompression, blast.DefaultCompression, blast.MaxCompression} {
+				opts := []blast.WriterOption{blast.WriterMode(blast.Mode(mode)), blast.WriterDictionarySize(blast.DictionarySize(dictSize)), blast.WriterLevel(level)}
+				for _, data := range [][]byte{text[:100], text} {
+					var expected bytes.Buffer
+					w, err := blast.NewWriterOptions(&expected, opts...)
+					if err != nil {
+						t.Fatalf("error creating writer %v", err)
+					}
+					if _, err := w.Write(data); err != nil {
+						t.Fatalf("error writing %v", err)
+					}
+					if err := w.Close(); err != nil {
+						t.Fatalf("error closing %v", err)
+					}
+
+					// Leave the buffers full of other data: a stream left
+					// unfinished, one that failed, and one of zeros
+					w.Reset(ioutil.Discard)
+					_, _ = w.Write(dirt)
+					w.Reset(failWriter{})
+					_, _ = w.Write(dirt)
+					_ = w.Close()
+					w.Reset(ioutil.Discard)
+					_, _ = w.Write(make([]byte, 0x1800))
+					_ = w.Close()
+
+					var b bytes.Buffer
+					w.Reset(&b)
+					if _, err := w.Write(data); err != nil {
+						t.Fatalf("error writing %v", err)
+					}
+					if err := w.Close(); err != nil {
+						t.Fatalf("error closing %v", err)
+					}
+					if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+						t.Errorf("mode=%v dictSize=%v level=%v length=%v: output differs from a new writer", mode, dictSize, level, len(data))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestInvalidLevel(t *testing.T) {
+	var b bytes.Buffer
+	for _, level := range []int{-3, 0, 10} {
+		if _, err := blast.NewWriterLevel(&b, blast.Binary, blast.DictionarySize1024, level); err != blast.ErrInvalidLevel {
+			t.Errorf("level=%v: found=%v : expected=%v", level, err, blast.ErrInvalidLevel)
+		}
+		if _, err := blast.NewWriterOptions(&b, blast.WriterLevel(level)); err != blast.ErrInvalidLevel {
+			t.Errorf("level=%v: found=%v : expected=%v", level, err, blast.ErrInvalidLevel)
+		}
+	}
+}
+
+func benchmarkEncode(b *testing.B, level int, data []byte) {
+	var buf bytes.Buffer
+	w, err := blast.NewWriterLevel(&buf, blast.ASCII, blast.DictionarySize4096, level)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w.Reset(&buf)
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Returns up to n bytes of the test binary, as an executable to compress.
+func benchmarkExecutable(b *testing.B, n int) []byte {
+	data, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		b.Skip(err)
+	}
+	if len(data) > n {
+		data = data[:n]
+	}
+	return data
+}
+
+func BenchmarkEncodeBestSpeed(b *testing.B) {
+	benchmarkEncode(b, blast.BestSpeed, benchmarkText(1<<20))
+}
+
+func BenchmarkEncodeDefault(b *testing.B) {
+	benchmarkEncode(b, blast.DefaultCompression, benchmarkText(1<<20))
+}
+
+func BenchmarkEncodeBestCompression(b *testing.B) {
+	benchmarkEncode(b, blast.BestCompression, benchmarkText(1<<20))
+}
+
+func BenchmarkEncodeMaxCompression(b *testing.B) {
+	benchmarkEncode(b, blast.MaxCompression, benchmarkText(1<<20))
+}
+
+func BenchmarkEncodeRandom(b *testing.B) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	benchmarkEncode(b, blast.DefaultCompression, data)
+}
+
+func BenchmarkEncodeLowEntropy(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(random.Intn(4))
+	}
+	benchmarkEncode(b, blast.DefaultCompression, data)
+}
+
+func BenchmarkEncodeRepetitive(b *testing.B) {
+	benchmarkEncode(b, blast.DefaultCompression, bytes.Repeat([]byte("abcdefgh0123"), 1<<17))
+}
+
+func BenchmarkEncodeExecutable(b *testing.B) {
+	benchmarkEncode(b, blast.DefaultCompression, benchmarkExecutable(b, 1<<20))
+}